@@ -0,0 +1,184 @@
+package torotator
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/uber-go/zap"
+)
+
+// ServeAdmin serves the admin API on addr until ctx is canceled. It offers:
+//
+//	GET  /status                 the same snapshot as the status file
+//	POST /proxies/{port}/recycle recycle the proxy whose Privoxy listens on port right away
+//	POST /proxies/{port}/drain   let the proxy's connections finish, then recycle it
+//	POST /pools/{port}/scale     keep ?size= proxies running in the pool whose frontend listens on port
+func ServeAdmin(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, CurrentStatus())
+	})
+	mux.HandleFunc("/proxies/", func(w http.ResponseWriter, r *http.Request) {
+		adminProxy(ctx, w, r)
+	})
+	mux.HandleFunc("/pools/", func(w http.ResponseWriter, r *http.Request) {
+		adminPool(ctx, w, r)
+	})
+
+	l, err := Listen(ctx, addr)
+	if err != nil {
+		log.Error("unable to serve admin API", zap.String("address", addr), zap.Error(err))
+		return
+	}
+
+	srv := &http.Server{Handler: mux}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	log.Info("serving admin API", zap.String("address", addr))
+	if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+		log.Error("admin API stopped", zap.Error(err))
+	}
+}
+
+// adminProxy handles actions on a single proxy, addressed by its Privoxy port.
+func adminProxy(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/proxies/"), "/"), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	port, err := strconv.Atoi(parts[0])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	h := backendOwner(port)
+	if h == nil {
+		http.Error(w, "no such proxy", http.StatusNotFound)
+		return
+	}
+
+	switch parts[1] {
+	case "recycle":
+		if !recycler.Recycle(port) {
+			http.Error(w, "no such proxy", http.StatusNotFound)
+			return
+		}
+
+		writeJSON(w, http.StatusAccepted, map[string]interface{}{"port": port, "status": "recycling"})
+
+	case "drain":
+		go func() {
+			if err := h.Drain(ctx, port); err != nil {
+				h.log.Warn("failed to drain backend", zap.Int("backend", port), zap.Error(err))
+			}
+
+			recycler.Recycle(port)
+		}()
+
+		writeJSON(w, http.StatusAccepted, map[string]interface{}{"port": port, "status": "draining"})
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// adminPool handles actions on a whole pool, addressed by its frontend port.
+func adminPool(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/pools/"), "/"), "/")
+	if len(parts) != 2 || parts[1] != "scale" {
+		http.NotFound(w, r)
+		return
+	}
+
+	port, err := strconv.Atoi(parts[0])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var h *HAProxy
+	for _, ha := range haproxies {
+		if ha.Port == port {
+			h = ha
+		}
+	}
+
+	if h == nil {
+		http.Error(w, "no such pool", http.StatusNotFound)
+		return
+	}
+
+	// a fan-out pool's proxies share one backend, and -once pins every pool to a single proxy
+	if cfg.FanoutInterval > 0 || cfg.Once {
+		http.Error(w, "pool size is fixed with -fanout-interval or -once", http.StatusConflict)
+		return
+	}
+
+	size, err := strconv.Atoi(r.FormValue("size"))
+	if err != nil || size <= 0 {
+		http.Error(w, "size must be a positive number", http.StatusBadRequest)
+		return
+	}
+
+	// every pool needs room in the port range at the size it would have
+	var pools PoolList
+	for _, ha := range haproxies {
+		p := *ha.pool
+		if p.Count = ha.Size(); ha == h {
+			p.Count = size
+		}
+		pools = append(pools, &p)
+	}
+
+	if err = ValidatePorts(pools); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	prev := h.Scale(ctx, size)
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{"port": port, "size": size, "previous": prev, "status": "scaling"})
+}
+
+// backendOwner returns the HAProxy with a backend on port, if any.
+func backendOwner(port int) *HAProxy {
+	for _, h := range haproxies {
+		for _, p := range h.BackendPorts() {
+			if p == port {
+				return h
+			}
+		}
+	}
+
+	return nil
+}
+
+// writeJSON responds with v encoded as JSON.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
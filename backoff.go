@@ -0,0 +1,41 @@
+package torotator
+
+import (
+	"context"
+	"time"
+)
+
+// Backoff computes exponentially increasing delays between retries, capped at Max.
+type Backoff struct {
+	Min time.Duration
+	Max time.Duration
+
+	attempts int
+}
+
+// Next records a failed attempt and returns how long to wait before the next one.
+func (b *Backoff) Next() time.Duration {
+	d := b.Min << uint(b.attempts)
+	if d > b.Max || d <= 0 {
+		d = b.Max
+	}
+
+	b.attempts++
+
+	return d
+}
+
+// Attempts returns the number of failed attempts recorded so far.
+func (b *Backoff) Attempts() int {
+	return b.attempts
+}
+
+// Sleep waits for d, returning early with the context's error if ctx is canceled first.
+func Sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
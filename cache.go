@@ -0,0 +1,116 @@
+package torotator
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uber-go/zap"
+)
+
+// TOR_CACHE_PATTERN matches the files in Tor's data directory that hold the consensus, certificates and descriptors it
+// has downloaded.
+const TOR_CACHE_PATTERN = "cached-*"
+
+// TorCache is a copy of the directory information Tor keeps in its data directory, shared by every Tor instance so that
+// a new one can bootstrap without downloading all of it again. The first instance to bootstrap once the copy is older
+// than -tor-cache-refresh brings it up to date.
+type TorCache struct {
+	dir string
+
+	mu         sync.Mutex
+	refreshed  time.Time
+	refreshing bool
+}
+
+// torCache is the shared cache, or nil when -tor-cache isn't set.
+var torCache *TorCache
+
+// NewTorCache prepares the shared cache in dir, which may hold a copy made by an earlier run.
+func NewTorCache(dir string) (c *TorCache, err error) {
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	c = &TorCache{dir: dir}
+
+	// the copy is only as fresh as the newest file in it
+	names, _ := filepath.Glob(filepath.Join(dir, TOR_CACHE_PATTERN))
+	for _, name := range names {
+		if info, err := os.Stat(name); err == nil && info.ModTime().After(c.refreshed) {
+			c.refreshed = info.ModTime()
+		}
+	}
+
+	return c, nil
+}
+
+// Seed copies the shared cache into a new Tor instance's data directory. Tor checks what it finds there and downloads
+// anything that is missing or out of date, so a failed copy only makes bootstrapping slower.
+func (c *TorCache) Seed(_log zap.Logger, dst string) {
+	n, err := copyCache(c.dir, dst)
+	if err != nil {
+		_log.Warn("failed to seed from the shared cache", zap.Error(err))
+		return
+	}
+
+	_log.Debug("seeded from the shared cache", zap.Int("files", n))
+}
+
+// Refresh copies the directory information from the data directory of a Tor instance that has just bootstrapped into
+// the shared cache, unless the cache is still fresh or another instance is already refreshing it.
+func (c *TorCache) Refresh(_log zap.Logger, src string) {
+	c.mu.Lock()
+	if c.refreshing || time.Since(c.refreshed) < cfg.TorCacheRefresh {
+		c.mu.Unlock()
+		return
+	}
+	c.refreshing = true
+	c.mu.Unlock()
+
+	n, err := copyCache(src, c.dir)
+
+	c.mu.Lock()
+	c.refreshing = false
+	if err == nil {
+		c.refreshed = time.Now()
+	}
+	c.mu.Unlock()
+
+	if err != nil {
+		_log.Warn("failed to refresh the shared cache", zap.Error(err))
+		return
+	}
+
+	_log.Info("refreshed the shared cache", zap.Int("files", n))
+}
+
+// copyCache copies every cache file from src to dst, returning how many were copied. Each file is replaced in one step,
+// so that a Tor instance being seeded at the same time never sees half of one.
+func copyCache(src, dst string) (n int, err error) {
+	names, err := filepath.Glob(filepath.Join(src, TOR_CACHE_PATTERN))
+	if err != nil {
+		return 0, err
+	}
+
+	for _, name := range names {
+		// Tor's own files that it is still writing
+		if strings.HasSuffix(name, ".tmp") {
+			continue
+		}
+
+		target := filepath.Join(dst, filepath.Base(name))
+		if err = copyFile(name, target+".tmp"); err == nil {
+			err = os.Rename(target+".tmp", target)
+		}
+		if err != nil {
+			return n, err
+		}
+
+		n++
+	}
+
+	return n, nil
+}
@@ -0,0 +1,217 @@
+package torotator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/uber-go/zap"
+)
+
+// ExitInfo describes the exit a request through Tor came out of, as reported by the check URL.
+type ExitInfo struct {
+	IP      string        `json:"IP"`
+	IsTor   bool          `json:"IsTor"`
+	Latency time.Duration `json:"-"`
+
+	// Connect is how long it took to have a connection to the check URL's host, and FirstByte how long the response
+	// took to start once the connection was there
+	Connect   time.Duration `json:"-"`
+	FirstByte time.Duration `json:"-"`
+}
+
+// probeClient returns an HTTP client that only ever goes through the proxy at via, ignoring any proxy set in the
+// environment. Every stage of a request, from dialing the proxy to reading the body, stops when its context is done.
+func probeClient(via *url.URL) *http.Client {
+	dialer := &net.Dialer{Timeout: cfg.CheckTimeout}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			// hostnames are passed through to Tor to resolve rather than leaking to the local resolver
+			Proxy:       http.ProxyURL(via),
+			DialContext: dialer.DialContext,
+
+			// the client is thrown away after one request, so there's nothing to keep connections open for
+			DisableKeepAlives: true,
+		},
+	}
+}
+
+// ProbeExit fetches the check URL through the proxy at via, either Tor's SOCKS port or Privoxy, returning the exit IP and
+// how long the request took. The probe gives up after -check-timeout, or as soon as ctx is canceled.
+func ProbeExit(ctx context.Context, via *url.URL) (info *ExitInfo, err error) {
+	ctx, cancel := context.WithTimeout(ctx, cfg.CheckTimeout)
+	defer cancel()
+
+	client := probeClient(via)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cfg.CheckURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var connected, firstByte time.Time
+	req = req.WithContext(httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn:              func(httptrace.GotConnInfo) { connected = time.Now() },
+		GotFirstResponseByte: func() { firstByte = time.Now() },
+	}))
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response from %s: %s", cfg.CheckURL, resp.Status)
+	}
+
+	info = new(ExitInfo)
+	if err = json.NewDecoder(resp.Body).Decode(info); err != nil {
+		return nil, fmt.Errorf("unable to parse response from %s: %v", cfg.CheckURL, err)
+	}
+	info.Latency = time.Since(start)
+	info.Connect = connected.Sub(start)
+	info.FirstByte = firstByte.Sub(connected)
+
+	return info, nil
+}
+
+// socksErrors describes the reply codes of a failed SOCKS5 request.
+var socksErrors = []string{
+	1: "general failure",
+	2: "connection not allowed",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// ProbeSocks checks Tor on its own, without Privoxy, by opening a connection through the SOCKS proxy at addr to the
+// host and port of the check URL. Tor only reports success once a circuit is built and its exit has connected, so this
+// tells whether Tor itself is working. The probe gives up after -check-timeout, or as soon as ctx is canceled.
+func ProbeSocks(ctx context.Context, addr string) (latency time.Duration, err error) {
+	ctx, cancel := context.WithTimeout(ctx, cfg.CheckTimeout)
+	defer cancel()
+
+	target, err := url.Parse(cfg.CheckURL)
+	if err != nil {
+		return 0, err
+	}
+
+	host, port := target.Hostname(), target.Port()
+	if port == "" {
+		port = "80"
+		if target.Scheme == "https" {
+			port = "443"
+		}
+	}
+	portNum, err := strconv.Atoi(port)
+	if err != nil || len(host) > 255 {
+		return 0, fmt.Errorf("unable to probe %s", target.Host)
+	}
+
+	start := time.Now()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	// the handshake is cut short as soon as ctx is done
+	go func() {
+		<-ctx.Done()
+		conn.SetDeadline(time.Now())
+	}()
+
+	// version 5, offering only "no authentication"
+	if _, err = conn.Write([]byte{5, 1, 0}); err != nil {
+		return 0, err
+	}
+
+	reply := make([]byte, 2)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return 0, err
+	}
+	if reply[0] != 5 || reply[1] != 0 {
+		return 0, fmt.Errorf("unexpected socks greeting %v", reply)
+	}
+
+	// CONNECT by hostname, which Tor resolves at the exit
+	req := append([]byte{5, 1, 0, 3, byte(len(host))}, host...)
+	req = append(req, byte(portNum>>8), byte(portNum))
+	if _, err = conn.Write(req); err != nil {
+		return 0, err
+	}
+
+	// the bound address that follows the first four bytes doesn't matter
+	reply = make([]byte, 4)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return 0, err
+	}
+
+	if code := int(reply[1]); code != 0 {
+		reason := "unknown error"
+		if code < len(socksErrors) {
+			reason = socksErrors[code]
+		}
+		return 0, fmt.Errorf("socks connect to %s:%s failed: %s", host, port, reason)
+	}
+
+	return time.Since(start), nil
+}
+
+// Check starts a single Tor instance, waits for it to bootstrap, and reports the exit it gets through it to w. Nothing
+// is added to any pool and neither HAProxy nor Privoxy is started.
+func (m *Manager) Check(ctx context.Context, w io.Writer) (err error) {
+	for _, dep := range Dependencies() {
+		if dep.Name != "tor" {
+			continue
+		}
+
+		if _, err = dep.Check(); err != nil {
+			return err
+		}
+	}
+
+	// the probe needs a TCP port to talk SOCKS to
+	cfg.TorSocket = false
+
+	start := time.Now()
+	tor, err := StartTor(ctx, m.pools[0].ExitCountries(), true)
+	if err != nil {
+		return fmt.Errorf("unable to start tor: %v", err)
+	}
+	defer tor.Close()
+
+	bootstrap := time.Since(start)
+	tor.log.Debug("probing exit", zap.String("url", cfg.CheckURL))
+
+	info, err := ProbeExit(ctx, &url.URL{Scheme: "socks5", Host: tor.SocksAddress()})
+	if err != nil {
+		return fmt.Errorf("unable to reach %s through tor: %v", cfg.CheckURL, err)
+	}
+
+	fmt.Fprintf(w, "exit ip:   %s\n", info.IP)
+	fmt.Fprintf(w, "is tor:    %t\n", info.IsTor)
+	fmt.Fprintf(w, "latency:   %s\n", info.Latency.Round(time.Millisecond))
+	fmt.Fprintf(w, "bootstrap: %s\n", bootstrap.Round(time.Millisecond))
+
+	if !info.IsTor {
+		return fmt.Errorf("%s does not recognize %s as a Tor exit", cfg.CheckURL, info.IP)
+	}
+
+	return nil
+}
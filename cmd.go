@@ -0,0 +1,282 @@
+package torotator
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/uber-go/zap"
+)
+
+// Cmd is a wrapper around exec.Cmd. It allows for stdout and stderr to automatically be logged along with everything
+// else in the application. It also provides helpers to check if the process has finished and also to clean up the
+// process.
+type Cmd struct {
+	log    zap.Logger
+	ctx    context.Context
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	stderr io.ReadCloser
+	done   chan struct{}
+
+	// reap makes sure the process is only ever waited on once, and err holds how that went once done is closed
+	reap sync.Once
+	err  error
+
+	// closing is set once Close has started killing the process
+	closing int32
+
+	transformLog func(string) (string, string, []zap.Field)
+}
+
+// STARTUP_POLL is how often a freshly started process is checked while waiting for it to settle.
+const STARTUP_POLL = 10 * time.Millisecond
+
+// NewCommand creates a new Cmd that is setup for common logging and state tracking.
+func NewCommand(ctx context.Context, log zap.Logger, name string, args ...string) (c *Cmd, err error) {
+	return StartCommand(ctx, log, nil, name, args...)
+}
+
+// StartCommand creates a new Cmd like NewCommand. If probe is not nil, it is polled during startup and the process is
+// considered up as soon as it returns true, rather than only after the full startup wait has elapsed.
+func StartCommand(ctx context.Context, log zap.Logger, probe func() bool, name string, args ...string) (c *Cmd, err error) {
+	c = &Cmd{
+		log:  log,
+		ctx:  ctx,
+		cmd:  exec.CommandContext(ctx, name, args...),
+		done: make(chan struct{}),
+	}
+
+	// run each child in its own process group so the whole group can be signaled on cleanup, and ask the kernel to
+	// take the child down with us where supported
+	c.cmd.SysProcAttr = childProcAttr()
+
+	if c.stdout, err = c.cmd.StdoutPipe(); err != nil {
+		c.log.Error("failed to setup stdout pipe", zap.Error(err))
+	}
+
+	if c.stderr, err = c.cmd.StderrPipe(); err != nil {
+		c.log.Error("failed to setup stderr pipe", zap.Error(err))
+	}
+
+	if err = c.cmd.Start(); err != nil {
+		c.log.Error("failed to start", zap.Error(err))
+		return nil, err
+	}
+
+	c.log = c.log.With(zap.Int("pid", c.cmd.Process.Pid))
+
+	// a process that can't be held to its limits isn't left running without them
+	if err = limitProcess(c.cmd.Process.Pid); err != nil {
+		c.log.Error("failed to apply resource limits", zap.Error(err))
+		c.Close()
+		return nil, err
+	}
+
+	if err = c.settle(probe); err != nil {
+		c.log.Error("exited during startup", zap.Error(err))
+		return nil, err
+	}
+
+	c.log.Info("running")
+
+	return c, nil
+}
+
+// settle waits for the process to either die or prove that it's up, giving up after the configured startup wait. A
+// process that is still alive at that point is assumed to be running.
+func (c *Cmd) settle(probe func() bool) error {
+	deadline := time.Now().Add(cfg.StartupWait)
+
+	for {
+		if processExited(c.cmd.Process.Pid) {
+			// log whatever it had to say and reap it so we can report why it died
+			c.Wait()
+			return &ExitError{State: c.state()}
+		}
+
+		if probe != nil && probe() {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return nil
+		}
+
+		time.Sleep(STARTUP_POLL)
+	}
+}
+
+// Pid returns the PID of the underlying command.
+func (c *Cmd) Pid() int {
+	if c.cmd == nil {
+		return -1
+	}
+
+	return c.cmd.Process.Pid
+}
+
+// Signal sends sig to the process.
+func (c *Cmd) Signal(sig os.Signal) error {
+	return c.cmd.Process.Signal(sig)
+}
+
+// Done returns a channel that signals when the process has ended.
+func (c *Cmd) Done() <-chan struct{} {
+	return c.done
+}
+
+// Wait processes output from the process and signals when the process has ended. Only the first call reaps the
+// process, while any others block until it has been reaped.
+func (c *Cmd) Wait() {
+	c.reap.Do(c.wait)
+}
+
+// wait does the work of Wait.
+func (c *Cmd) wait() {
+	var wg sync.WaitGroup
+
+	// stdout and stderr are read separately so that lines from one can't be split up by the other, and so that
+	// anything on stderr can be treated as more serious by default
+	wg.Add(2)
+	go func() {
+		c.logOutput(c.stdout, "")
+		wg.Done()
+	}()
+	go func() {
+		c.logOutput(c.stderr, "warn")
+		wg.Done()
+	}()
+	wg.Wait()
+
+	// wait for the underlying process to finish and record how it went
+	err := c.cmd.Wait()
+	c.err = exitError(err, c.cmd.ProcessState)
+	if state := c.cmd.ProcessState; state != nil {
+		fields := []zap.Field{zap.Int("exit_code", state.ExitCode())}
+		if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			fields = append(fields, zap.String("signal", ws.Signal().String()))
+		}
+
+		switch {
+		case state.Success():
+			c.log.Info("exited", fields...)
+		case errors.Is(c.err, ErrProcessKilled) && c.stopping():
+			// killed by us, as every process is when it's done with
+			c.log.Info("exited", fields...)
+		default:
+			c.log.Warn("exited", append(fields, zap.Error(err))...)
+		}
+	}
+
+	// signal that the command has ended
+	close(c.done)
+}
+
+// stopping reports whether the process is being stopped on purpose, either by Close or by its context being canceled.
+func (c *Cmd) stopping() bool {
+	return atomic.LoadInt32(&c.closing) == 1 || c.ctx.Err() != nil
+}
+
+// logOutput logs each line read from r until it is exhausted. Lines that the command's log transformer doesn't assign a
+// level to are logged at defaultLevel. The logger serializes entries itself, so lines from concurrent readers are never
+// interleaved.
+func (c *Cmd) logOutput(r io.Reader, defaultLevel string) {
+	var (
+		line   string
+		fields []zap.Field
+		level  string
+		lf     func(string, ...zap.Field)
+	)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line = scanner.Text()
+		level = ""
+		fields = nil
+
+		// optionally process output from the command to make common logging more useful
+		if c.transformLog != nil {
+			level, line, fields = c.transformLog(line)
+		}
+
+		if level == "" {
+			level = defaultLevel
+		}
+
+		switch level {
+		case "debug":
+			lf = c.log.Debug
+		case "warn":
+			lf = c.log.Warn
+		case "err", "error", "fatal":
+			lf = c.log.Error
+		default:
+			lf = c.log.Info
+		}
+
+		lf(line, fields...)
+	}
+
+	if err := scanner.Err(); err != nil {
+		c.log.Error("output error", zap.Error(err))
+	}
+}
+
+// ExitCode returns the exit code of the process once it has ended, or -1 if it is still running or was terminated by a
+// signal.
+func (c *Cmd) ExitCode() int {
+	state := c.state()
+	if state == nil {
+		return -1
+	}
+
+	return state.ExitCode()
+}
+
+// exited reports whether the process has ended and been reaped.
+func (c *Cmd) exited() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// state returns how the process ended, or nil while it is still running. ProcessState is written by whoever reaps the
+// process, so it is only read once c.done says that has happened.
+func (c *Cmd) state() *os.ProcessState {
+	if !c.exited() {
+		return nil
+	}
+
+	return c.cmd.ProcessState
+}
+
+// Close does its best to clean up the process.
+func (c *Cmd) Close() (err error) {
+	if c.exited() {
+		return nil
+	}
+
+	atomic.StoreInt32(&c.closing, 1)
+
+	c.log.Debug("killing process group")
+	if err = killGroup(c.cmd.Process.Pid); err != nil {
+		return
+	}
+
+	// Wait may already be reaping the process, in which case this just waits for it to finish
+	c.log.Debug("waiting for process to exit")
+	c.Wait()
+
+	return c.err
+}
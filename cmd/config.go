@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/codekoala/torotator"
+	"github.com/uber-go/zap"
+)
+
+// reloadable lists the flags whose new values in the config file take effect on SIGHUP. Anything else needs a restart.
+var reloadable = map[string]bool{
+	"allow":            true,
+	"maxconn":          true,
+	"defaults-maxconn": true,
+	"server-maxconn":   true,
+	"timeout-connect":  true,
+	"timeout-client":   true,
+	"timeout-server":   true,
+	"sticky":           true,
+	"retries":          true,
+	"redispatch":       true,
+
+	"backend-keep-alive":         true,
+	"backend-keep-alive-timeout": true,
+}
+
+// givenFlags holds the flags set on the command line or in the environment, which the config file never overrides.
+var givenFlags = make(map[string]bool)
+
+// Setting is a single "name = value" line from the config file.
+type Setting struct {
+	Name  string
+	Value string
+	Line  int
+}
+
+// ReadConfig parses the config file at name. Each line sets a flag, named without the leading dash, as "name = value".
+// Blank lines and lines starting with # are ignored, and repeatable flags such as pool may appear more than once.
+func ReadConfig(name string) (settings []Setting, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("%s:%d: expected name = value", name, n)
+		}
+
+		settings = append(settings, Setting{
+			Name:  strings.TrimSpace(line[:eq]),
+			Value: strings.TrimSpace(line[eq+1:]),
+			Line:  n,
+		})
+	}
+
+	return settings, scanner.Err()
+}
+
+// LoadConfig applies the config file named by -config, if any, to every flag that wasn't given on the command line or in
+// the environment.
+func LoadConfig(fs *flag.FlagSet) error {
+	fs.Visit(func(f *flag.Flag) {
+		givenFlags[f.Name] = true
+	})
+
+	if *configFile == "" {
+		return nil
+	}
+
+	settings, err := ReadConfig(*configFile)
+	if err != nil {
+		return err
+	}
+
+	return ApplyConfig(fs, settings)
+}
+
+// ApplyConfig sets each flag named in settings that wasn't given on the command line or in the environment.
+func ApplyConfig(fs *flag.FlagSet, settings []Setting) error {
+	for _, s := range settings {
+		if fs.Lookup(s.Name) == nil {
+			return fmt.Errorf("line %d: unknown setting %q", s.Line, s.Name)
+		}
+
+		if givenFlags[s.Name] {
+			continue
+		}
+
+		if err := fs.Set(s.Name, s.Value); err != nil {
+			return fmt.Errorf("line %d: invalid value %q for %s: %v", s.Line, s.Value, s.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// ReloadConfig re-reads the config file and has m apply any reloadable settings, putting reloadable settings that were
+// removed from the file back to their defaults. The new values are set on a copy of the settings in fs, which m checks
+// before applying anything, so the current values are kept if anything is wrong. Without a config file, m applies the
+// current settings again.
+func ReloadConfig(fs *flag.FlagSet, m *torotator.Manager) (err error) {
+	next := *cfg
+	if *configFile == "" {
+		return m.Reload(&next)
+	}
+
+	settings, err := ReadConfig(*configFile)
+	if err != nil {
+		return err
+	}
+
+	// the settings in use are never changed, only the copy m applies
+	nextFlags := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+	bindFlags(nextFlags, &next)
+
+	wanted := make(map[string]string)
+	for _, s := range settings {
+		f := fs.Lookup(s.Name)
+		if f == nil {
+			return fmt.Errorf("line %d: unknown setting %q", s.Line, s.Name)
+		}
+
+		if !reloadable[s.Name] {
+			if _, repeatable := f.Value.(*torotator.PoolList); !repeatable && !givenFlags[s.Name] && f.Value.String() != s.Value {
+				log.Warn("setting changed but requires a restart", zap.String("name", s.Name))
+			}
+			continue
+		}
+
+		wanted[s.Name] = s.Value
+	}
+
+	for name := range reloadable {
+		if givenFlags[name] {
+			continue
+		}
+
+		value, ok := wanted[name]
+		if !ok {
+			value = fs.Lookup(name).DefValue
+		}
+
+		if err = nextFlags.Set(name, value); err != nil {
+			return fmt.Errorf("invalid value %q for %s: %v", value, name, err)
+		}
+	}
+
+	return m.Reload(&next)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/codekoala/torotator"
+)
+
+// ENV_PREFIX starts the name of every environment variable that may stand in for a flag.
+const ENV_PREFIX = "TOROTATOR_"
+
+// envNames spells out the environment variables for single-letter flags, which would be cryptic otherwise.
+var envNames = map[string]string{
+	"p": "PROXY_PORT",
+	"c": "TOR_COUNT",
+	"s": "PORT_RANGE_START",
+	"e": "PORT_RANGE_END",
+	"m": "MAX_PROXY_TIME",
+	"t": "CIRCUIT_TIME",
+	"v": "VERSION",
+}
+
+// EnvName returns the environment variable that may be used in place of the named flag, such as TOROTATOR_TOR_COUNT
+// for -c or TOROTATOR_EXIT_COUNTRIES for -exit-countries.
+func EnvName(flagName string) string {
+	if name, ok := envNames[flagName]; ok {
+		return ENV_PREFIX + name
+	}
+
+	return ENV_PREFIX + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// ApplyEnv sets every flag that wasn't given on the command line from its environment variable, if that is set.
+// Repeatable flags, such as -pool, take whitespace-separated values.
+func ApplyEnv(fs *flag.FlagSet) (err error) {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || explicit[f.Name] {
+			return
+		}
+
+		value, ok := os.LookupEnv(EnvName(f.Name))
+		if !ok {
+			return
+		}
+
+		values := []string{value}
+		if _, repeatable := f.Value.(*torotator.PoolList); repeatable {
+			values = strings.Fields(value)
+		}
+
+		for _, v := range values {
+			if serr := f.Value.Set(v); serr != nil {
+				err = fmt.Errorf("invalid value %q for %s: %v", v, EnvName(f.Name), serr)
+				return
+			}
+		}
+	})
+
+	return err
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/uber-go/zap"
+)
+
+// logFile is the file logs are written to with -log-file, or nil when logging to stdout.
+var logFile *LogFile
+
+// LogFile is a log file that can be reopened, so that it may be rotated by moving it aside and sending SIGHUP.
+type LogFile struct {
+	name string
+	mu   sync.Mutex
+	f    *os.File
+}
+
+// OpenLogFile opens the log file at name for appending, creating it if needed.
+func OpenLogFile(name string) (*LogFile, error) {
+	l := &LogFile{name: name}
+	if err := l.Reopen(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Reopen closes the log file and opens it again by name, picking up a new file if the old one was moved away.
+func (l *LogFile) Reopen() error {
+	f, err := os.OpenFile(l.name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	prev := l.f
+	l.f = f
+	l.mu.Unlock()
+
+	if prev != nil {
+		prev.Close()
+	}
+
+	return nil
+}
+
+func (l *LogFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.f.Write(p)
+}
+
+func (l *LogFile) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.f.Sync()
+}
+
+// NewLogger builds the application logger according to -log-format and -log-file.
+func NewLogger() (zap.Logger, error) {
+	var enc zap.Encoder
+	switch *logFormat {
+	case "json":
+		enc = zap.NewJSONEncoder(zap.RFC3339Formatter("time"))
+	case "console":
+		enc = zap.NewTextEncoder(zap.TextTimeFormat(time.RFC3339))
+	default:
+		return nil, fmt.Errorf("unknown log format %q", *logFormat)
+	}
+
+	var opts []zap.Option
+	if *logFilePath != "" {
+		f, err := OpenLogFile(*logFilePath)
+		if err != nil {
+			return nil, err
+		}
+
+		logFile = f
+		opts = append(opts, zap.Output(f), zap.ErrorOutput(f))
+	}
+
+	l := zap.New(enc, opts...)
+	if cfg.Debug {
+		l.SetLevel(zap.DebugLevel)
+	}
+
+	return l, nil
+}
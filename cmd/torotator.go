@@ -1,197 +1,282 @@
+// Command torotator runs pools of rotating Tor proxies as configured by its flags, the environment and an optional config
+// file. Everything else is done by the torotator package.
 package main
 
 import (
 	"context"
 	"flag"
+	"fmt"
 	"os"
-	"os/exec"
 	"os/signal"
-	"sync"
 	"syscall"
 	"time"
 
+	"github.com/codekoala/torotator"
 	"github.com/uber-go/zap"
 )
 
 var (
 	VERSION = "dev"
 
-	proxyPort      = flag.Int("p", 8080, "HTTP proxy port")
-	torCount       = flag.Int("c", 3, "number of Tor nodes to use")
-	portRangeStart = flag.Int("s", 30000, "starting port for proxy usage")
-	maxProxyTime   = flag.Int("m", 900, "maximum time (in seconds) a proxy should remain online before being recycled")
-	circuitTime    = flag.Int("t", 120, "maximum time (in seconds) a Tor node should be online before recircuiting")
-	statsPort      = flag.Int("stats", 0, "serve HAProxy stats on this port")
-	debug          = flag.Bool("debug", false, "enable debug mode")
-	version        = flag.Bool("v", false, "show version and exit")
+	// cfg holds every setting the torotator package takes, each of which has a flag of its own
+	cfg = torotator.DefaultConfig()
+
+	maxRuntime  = flag.Duration("max-runtime", 0, "shut down cleanly after running for this long, as if sent SIGTERM (0 runs until stopped)")
+	configFile  = flag.String("config", "", "file of \"name = value\" lines setting any flag; reloadable settings are re-read on SIGHUP")
+	logFilePath = flag.String("log-file", "", "write logs to this file instead of stdout; reopened on SIGHUP")
+	logFormat   = flag.String("log-format", "json", "log format: json or console")
+	version     = flag.Bool("v", false, "show version and exit")
 
 	log zap.Logger
 )
 
 func init() {
-	flag.Parse()
-
-	log = zap.New(zap.NewJSONEncoder(zap.RFC3339Formatter("time")))
-	if *debug {
-		log.SetLevel(zap.DebugLevel)
-	}
-
-	log.Info("rotating tor proxy", zap.String("version", VERSION))
-	if *version {
-		os.Exit(0)
-	}
+	bindFlags(flag.CommandLine, cfg)
+}
 
-	ports = make(map[int]int)
+// bindFlags defines a flag on fs for each setting in c, with the value already in c as its default.
+func bindFlags(fs *flag.FlagSet, c *torotator.Config) {
+	fs.IntVar(&c.ProxyPort, "p", c.ProxyPort, "HTTP proxy port")
+	fs.StringVar(&c.BindAddress, "bind", c.BindAddress, "address the HTTP proxy listens on")
+	fs.IntVar(&c.TorCount, "c", c.TorCount, "number of Tor nodes to use")
+	fs.StringVar(&c.TLSCert, "tls-cert", c.TLSCert, "PEM certificate to serve the proxy over TLS with; may also contain the private key")
+	fs.StringVar(&c.TLSKey, "tls-key", c.TLSKey, "PEM private key for -tls-cert, if it is not in the same file")
+	fs.StringVar(&c.Allow, "allow", c.Allow, "comma-separated CIDR ranges or addresses allowed to use the proxy; everyone is allowed when empty")
+	fs.DurationVar(&c.FanoutInterval, "fanout-interval", c.FanoutInterval, "run a single Privoxy per pool that switches between the pool's Tor instances this often, instead of one Privoxy per Tor; 0 disables")
+	fs.Float64Var(&c.DirectRatio, "direct-ratio", c.DirectRatio, "share (0 to 1) of each pool that bypasses Tor and connects directly, for comparison; these requests come from this host's own IP")
+	fs.StringVar(&c.EntryNodes, "entry-nodes", c.EntryNodes, "comma-separated relay fingerprints, nicknames or {cc} country codes every Tor instance must use as entry guards")
+	fs.StringVar(&c.ExitCountries, "exit-countries", c.ExitCountries, "comma-separated country codes (e.g. us,de) Tor exit nodes must be located in, or weighted codes (e.g. us:50,de:30,nl:20) to pin each Tor node to one country picked by weight")
+	fs.IntVar(&c.PortRangeStart, "s", c.PortRangeStart, "starting port for proxy usage")
+	fs.IntVar(&c.PortRangeEnd, "e", c.PortRangeEnd, "port (exclusive) at which the range starting at -s ends")
+	fs.StringVar(&c.PortList, "ports", c.PortList, "comma-separated list of the only ports to use for Tor and Privoxy, instead of a range starting at -s")
+	fs.IntVar(&c.MaxProxyTime, "m", c.MaxProxyTime, "maximum time (in seconds) a proxy should remain online before being recycled")
+	fs.BoolVar(&c.CircuitInfo, "circuit-info", c.CircuitInfo, "log the relays each proxy's circuit goes through, including the exit's country, and show them in the status file")
+	fs.StringVar(&c.RotationStrategy, "rotation-strategy", c.RotationStrategy, "when proxies get new circuits: timed (every -m), per-request (new circuit after requests, via the control port) or manual (only on SIGUSR1 or the admin API)")
+	fs.BoolVar(&c.Once, "once", c.Once, "run a single proxy per pool that is only replaced if it fails, ignoring -m")
+	fs.IntVar(&c.LifetimeJitter, "jitter", c.LifetimeJitter, "randomly lengthen or shorten each proxy's lifetime by up to this many seconds")
+	fs.IntVar(&c.MinHealthy, "min-healthy", c.MinHealthy, "keep an expired proxy running until at least this many other proxies in its pool are healthy")
+	fs.DurationVar(&c.MinHealthyWait, "min-healthy-wait", c.MinHealthyWait, "longest an expired proxy waits for -min-healthy to be met")
+	fs.DurationVar(&c.LiveTimeout, "live-timeout", c.LiveTimeout, "how long HAProxy may take to report a new proxy as up before it's recycled (0 doesn't wait)")
+	fs.IntVar(&c.WarmupTime, "warmup", c.WarmupTime, "time (in seconds) a new proxy receives reduced traffic while its circuit warms up")
+	fs.StringVar(&c.SocksFlags, "socks-flags", c.SocksFlags, "comma-separated Tor SocksPort flags to add, such as PreferIPv6 or OnionTrafficOnly")
+	fs.BoolVar(&c.IsolateSOCKSAuth, "isolate-socks-auth", c.IsolateSOCKSAuth, "give each distinct set of SOCKS credentials its own Tor circuit")
+	fs.IntVar(&c.WarmSpares, "warm-spares", c.WarmSpares, "number of bootstrapped Tor nodes to keep in reserve per pool for replacing expired proxies")
+	fs.IntVar(&c.BootstrapConcurrency, "bootstrap-concurrency", c.BootstrapConcurrency, "maximum number of Tor nodes bootstrapping at once across all pools (0 is unlimited)")
+	fs.DurationVar(&c.BootstrapTimeout, "bootstrap-timeout", c.BootstrapTimeout, "replace a Tor node that hasn't finished bootstrapping within this long (0 waits forever)")
+	fs.StringVar(&c.StartupOrder, "startup-order", c.StartupOrder, "how each proxy starts: sequential (Privoxy once Tor is running) or parallel (both at once, which is faster)")
+	fs.DurationVar(&c.StartupStagger, "startup-stagger", c.StartupStagger, "roughly how far apart to start each proxy while a pool first fills, randomized by up to half either way (0 starts them all at once)")
+	fs.DurationVar(&c.ReplaceInterval, "replace-interval", c.ReplaceInterval, "start at most one replacement proxy per pool this often, once the pool has filled; 0 replaces proxies as soon as they end")
+	fs.DurationVar(&c.RecycleStagger, "recycle-stagger", c.RecycleStagger, "delay between recycling each proxy when SIGUSR1 recycles the whole pool")
+	fs.IntVar(&c.HAProxyAttempts, "haproxy-attempts", c.HAProxyAttempts, "number of times to try starting each HAProxy at startup before giving up")
+	fs.IntVar(&c.TorAttempts, "tor-attempts", c.TorAttempts, "number of times to retry starting a Tor node before giving up on it")
+	fs.BoolVar(&c.SharedCache, "tor-cache", c.SharedCache, "seed each new Tor node with the directory information downloaded by earlier ones, kept in -data-dir, so it bootstraps faster")
+	fs.DurationVar(&c.TorCacheRefresh, "tor-cache-refresh", c.TorCacheRefresh, "how old the shared Tor cache may get before the next Tor node to bootstrap refreshes it")
+	fs.IntVar(&c.SocksPorts, "socks-ports", c.SocksPorts, "number of SocksPorts each Tor node opens, each serving a proxy of its own with independent circuits, to save memory in large pools")
+	fs.BoolVar(&c.TorSocket, "tor-unix-socket", c.TorSocket, "have Tor accept SOCKS connections on a Unix socket in its data directory instead of a TCP port; requires a Privoxy that can forward to Unix sockets")
+	fs.StringVar(&c.UpstreamProxy, "upstream-proxy", c.UpstreamProxy, "host:port of an HTTP proxy that Tor (and any -direct-ratio backends) must use to reach the internet")
+	fs.StringVar(&c.UpstreamProxyAuth, "upstream-proxy-auth", c.UpstreamProxyAuth, "user:password for -upstream-proxy")
+	fs.StringVar(&c.TorLogLevel, "tor-log-level", c.TorLogLevel, "Tor log verbosity: err, warn, notice, info or debug (default warn, or notice with -debug)")
+	fs.IntVar(&c.CircuitTime, "t", c.CircuitTime, "maximum time (in seconds) a Tor node should be online before recircuiting")
+	fs.IntVar(&c.CircuitDirtiness, "circuit-dirtiness", c.CircuitDirtiness, "maximum time (in seconds) Tor keeps attaching new streams to a circuit (default is Tor's own, 600)")
+	fs.DurationVar(&c.TimeoutConnect, "timeout-connect", c.TimeoutConnect, "maximum time HAProxy waits to connect to a backend")
+	fs.DurationVar(&c.TimeoutClient, "timeout-client", c.TimeoutClient, "maximum inactivity time on the client side")
+	fs.StringVar(&c.BackendKeepAlive, "backend-keep-alive", c.BackendKeepAlive, "how HAProxy treats connections to Privoxy: server-close (one request each), keep-alive (kept open per client), or reuse (shared between clients)")
+	fs.DurationVar(&c.BackendKeepAliveTime, "backend-keep-alive-timeout", c.BackendKeepAliveTime, "how long HAProxy waits for the next request on an idle keep-alive connection")
+	fs.DurationVar(&c.TimeoutServer, "timeout-server", c.TimeoutServer, "maximum inactivity time on the server side")
+	fs.DurationVar(&c.ReloadDelay, "reload-delay", c.ReloadDelay, "how long to collect backend changes before reloading HAProxy")
+	fs.DurationVar(&c.ReloadMaxDelay, "reload-max-delay", c.ReloadMaxDelay, "longest -reload-delay may grow to while backends churn")
+	fs.DurationVar(&c.ReloadTimeout, "reload-timeout", c.ReloadTimeout, "longest to wait for a replacement HAProxy to start on reload before keeping the current one")
+	fs.IntVar(&c.Retries, "retries", c.Retries, "number of times HAProxy retries connecting to a backend")
+	fs.BoolVar(&c.Redispatch, "redispatch", c.Redispatch, "let HAProxy retry on a different backend when one fails")
+	fs.IntVar(&c.MaxConn, "maxconn", c.MaxConn, "maximum number of concurrent connections HAProxy accepts")
+	fs.IntVar(&c.DefaultMaxConn, "defaults-maxconn", c.DefaultMaxConn, "maximum connections per HAProxy proxy section (default: same as -maxconn)")
+	fs.IntVar(&c.ServerMaxConn, "server-maxconn", c.ServerMaxConn, "maximum connections to each Tor+Privoxy backend (default: -maxconn divided by -c)")
+	fs.StringVar(&c.ForwardedFor, "forwarded-for", c.ForwardedFor, "X-Forwarded-For handling: strip client headers (anonymous), preserve them as-is, or append the client IP")
+	fs.BoolVar(&c.Anonymize, "anonymize", c.Anonymize, "have Privoxy strip or normalize identifying request headers such as User-Agent and Referer")
+	fs.StringVar(&c.HealthPath, "health-path", c.HealthPath, "path on the proxy port that HAProxy answers with 200 itself, for load balancer health checks (empty disables)")
+	fs.DurationVar(&c.StickyTTL, "sticky", c.StickyTTL, "keep sending each client IP to the same backend for this long (0 disables)")
+	fs.StringVar(&c.HAProxyUser, "haproxy-user", c.HAProxyUser, "user HAProxy switches to after binding its ports; requires running as root")
+	fs.StringVar(&c.HAProxyGroup, "haproxy-group", c.HAProxyGroup, "group HAProxy switches to after binding its ports; requires running as root")
+	fs.StringVar(&c.HAProxyConfigOut, "haproxy-config-out", c.HAProxyConfigOut, "also write each generated HAProxy config to this file, for inspection; with several pools, each pool's port is added to the name")
+	fs.StringVar(&c.HAProxyExtraFile, "haproxy-extra", c.HAProxyExtraFile, "file of extra HAProxy directives appended to each generated config, which is then checked with haproxy -c before it's used")
+	fs.IntVar(&c.HAProxyMaxProcs, "haproxy-max-procs", c.HAProxyMaxProcs, "most HAProxy processes each pool may have at once, counting old ones still finishing up; reloads wait for room (0 is unlimited, otherwise at least 2)")
+	fs.BoolVar(&c.HAProxyMasterWorker, "haproxy-master-worker", c.HAProxyMasterWorker, "run HAProxy in master-worker mode and reload it by signaling the master rather than starting a new process; requires HAProxy 1.9")
+	fs.StringVar(&c.HAProxyLog, "haproxy-log", c.HAProxyLog, "what HAProxy logs about each request: none, tcp (connections only) or http (full request lines)")
+	fs.IntVar(&c.StatsPort, "stats", c.StatsPort, "serve HAProxy stats on this port")
+	fs.StringVar(&c.StatsConflict, "stats-conflict", c.StatsConflict, "what to do when the -stats port is already in use: fail, next (use the next free port) or disable")
+	fs.DurationVar(&c.StatsInterval, "stats-interval", c.StatsInterval, "how often to log per-backend traffic statistics from HAProxy (0 disables)")
+	fs.BoolVar(&c.IPv6, "ipv6", c.IPv6, "also serve the HTTP proxy over IPv6 and allow Tor to use IPv6 exits")
+	fs.DurationVar(&c.HealthInterval, "health-interval", c.HealthInterval, "probe each proxy's exit through -check-url this often, recycling it after -health-failures failures in a row; 0 disables")
+	fs.IntVar(&c.HealthFailures, "health-failures", c.HealthFailures, "consecutive failed health checks before a proxy is recycled")
+	fs.DurationVar(&c.ExitCooldown, "exit-cooldown", c.ExitCooldown, "how long new Tor instances avoid an exit that failed its health checks; 0 disables")
+	fs.StringVar(&c.CheckURL, "check-url", c.CheckURL, "URL that reports the exit IP of a request as JSON, used by \"torotator check\" and health checks")
+	fs.DurationVar(&c.CheckTimeout, "check-timeout", c.CheckTimeout, "how long a request to -check-url may take")
+	fs.IntVar(&c.PrivoxyBufferLimit, "privoxy-buffer-limit", c.PrivoxyBufferLimit, "size (in KB) of the buffer Privoxy uses for content it filters")
+	fs.DurationVar(&c.PrivoxyKeepAlive, "privoxy-keep-alive-timeout", c.PrivoxyKeepAlive, "how long Privoxy keeps idle client connections open")
+	fs.DurationVar(&c.PrivoxySocketTimeout, "privoxy-socket-timeout", c.PrivoxySocketTimeout, "how long Privoxy waits for data on a connection before giving up")
+	fs.StringVar(&c.StatusFile, "status-file", c.StatusFile, "periodically write a JSON snapshot of the pool to this file (default status.json in -data-dir)")
+	fs.StringVar(&c.HAProxyBin, "haproxy-bin", c.HAProxyBin, "name or path of the HAProxy executable")
+	fs.StringVar(&c.PrivoxyBin, "privoxy-bin", c.PrivoxyBin, "name or path of the Privoxy executable")
+	fs.StringVar(&c.TorBin, "tor-bin", c.TorBin, "name or path of the Tor executable")
+	fs.StringVar(&c.EventsFile, "events", c.EventsFile, "append proxy lifecycle events as JSON lines to this file")
+	fs.IntVar(&c.MaxOpenFiles, "max-open-files", c.MaxOpenFiles, "limit each Tor, Privoxy and HAProxy process to this many open files (0 leaves the inherited limit alone); Linux only")
+	fs.IntVar(&c.MaxMemory, "max-memory", c.MaxMemory, "limit the address space of each Tor, Privoxy and HAProxy process to this many MB (0 is unlimited); Linux only")
+	fs.StringVar(&c.Cgroup, "cgroup", c.Cgroup, "path of an existing cgroup v2 directory to move each Tor, Privoxy and HAProxy process into; Linux only")
+	fs.DurationVar(&c.StartupWait, "startup-wait", c.StartupWait, "maximum time to wait for a child process to prove it started successfully")
+	fs.StringVar(&c.DataDir, "data-dir", c.DataDir, "directory where runtime data for each service is kept")
+	fs.StringVar(&c.AdminAddr, "admin", c.AdminAddr, "serve the admin API on this host:port, such as 127.0.0.1:8099 (empty disables)")
+	fs.DurationVar(&c.DrainTimeout, "drain-timeout", c.DrainTimeout, "longest the admin API waits for a draining backend's connections to finish before recycling it")
+	fs.IntVar(&c.PprofPort, "pprof-port", c.PprofPort, "serve Go profiling data on this port on 127.0.0.1 (0 disables)")
+	fs.Int64Var(&c.Seed, "seed", c.Seed, "seed for random decisions such as lifetime jitter, for reproducible runs (default is time-based)")
+	fs.BoolVar(&c.Debug, "debug", c.Debug, "enable debug mode")
+	fs.BoolVar(&c.DryRun, "dry-run", c.DryRun, "print the generated configuration and exit without starting anything")
+
+	fs.Var(c.KeepData, "keep-data", "leave data directories in place on exit for debugging: on its own for every service, or a comma-separated list of haproxy, privoxy and tor")
+	fs.Var(&c.Pools, "pool", "run an additional independent pool, as PORT:COUNT[:CC,CC,...] or PORT:COUNT:CC:WEIGHT,...; may be repeated, replacing -p, -c and -exit-countries")
 }
 
 func main() {
-	FindDependencies()
-
-	ctx := SignalContext()
-	wg := new(sync.WaitGroup)
+	flag.Parse()
 
-	ha, err := NewHAProxy(ctx, *proxyPort)
-	if err != nil {
-		log.Fatal("failed to start HAproxy", zap.Error(err))
+	// flags given on the command line win over the environment, which wins over the config file
+	settingsErr := ApplyEnv(flag.CommandLine)
+	if settingsErr == nil {
+		settingsErr = LoadConfig(flag.CommandLine)
 	}
 
-	defer ha.Close()
-	go ha.Wait()
-	go ReloadOnHUP(ctx, ha)
-
-	Rotate(ctx, wg, ha)
-
-	// clean up
-	wg.Wait()
-	log.Info("done")
-}
+	var logErr error
+	if log, logErr = NewLogger(); logErr != nil {
+		// fall back to the default so there's somewhere to complain
+		log = zap.New(zap.NewJSONEncoder(zap.RFC3339Formatter("time")))
+		log.Fatal("unable to set up logging", zap.Error(logErr))
+	}
 
-func FindDependencies() {
-	var (
-		found string
-		err   error
-	)
-
-	deps := []string{"haproxy", "privoxy", "tor"}
-	for _, dep := range deps {
-		if found, err = exec.LookPath(dep); err != nil {
-			log.Fatal("missing required program", zap.String("name", dep))
-		} else {
-			log.Debug("found required program", zap.String("name", dep), zap.String("path", found))
-		}
+	if settingsErr != nil {
+		log.Fatal("invalid settings", zap.Error(settingsErr))
 	}
-}
 
-// Rotate manages pairs of Tor+Privoxy services. Only a specific number of pairs are permitted at one time. When a pair
-// expires, a new pair will automatically take its place.
-func Rotate(ctx context.Context, wg *sync.WaitGroup, ha *HAProxy) {
-	// Used to limit the number of running proxies. This is separate from wg because wg is unbounded.
-	c := make(chan bool, *torCount)
+	log.Info("rotating tor proxy", zap.String("version", VERSION))
+	if *version {
+		os.Exit(0)
+	}
 
-	for {
-		select {
-		case <-ctx.Done():
-			// application terminating
-			close(c)
-			return
-
-		default:
-			c <- true
-
-			// time to create a new pair
-			wg.Add(1)
-			go func() {
-				RunProxy(ctx, ha)
-
-				wg.Done()
-				<-c
-			}()
-		}
+	if *maxRuntime < 0 {
+		log.Fatal("invalid configuration", zap.Error(fmt.Errorf("max-runtime must not be negative, got %s", *maxRuntime)))
 	}
-}
 
-// RunProxy creates a Tor node, followed by a Privoxy instance that handles proxying HTTP requests to the new Tor node.
-// The HAProxy instance is notified of the new pair so it can reconfigure itself to use the new pair. If either the Tor
-// node or the Privoxy service fail, the pair is invalidated and removed from HAProxy.
-func RunProxy(ctx context.Context, ha *HAProxy) {
-	// create a new tor/privoxy pair
-	tor, err := NewTor(ctx)
+	cfg.Log = log
+	m, err := torotator.NewManager(cfg)
 	if err != nil {
-		tor.Close()
+		log.Fatal("unable to set up", zap.Error(err))
+	}
+
+	if cfg.DryRun {
+		if err := m.DryRun(os.Stdout); err != nil {
+			log.Fatal("failed to render configuration", zap.Error(err))
+		}
 		return
 	}
 
-	privoxy, err := NewPrivoxy(ctx, tor)
-	if err != nil {
-		tor.Close()
-		privoxy.Close()
+	// test a single exit, leaving anything else running in the data directory alone
+	if flag.Arg(0) == "check" {
+		if err := m.Check(SignalContext(), os.Stdout); err != nil {
+			log.Fatal("check failed", zap.Error(err))
+		}
 		return
 	}
 
-	// mark the ports as used
-	mapPorts(tor.port, privoxy.port)
-
-	_log := log.With(zap.Int("tor", tor.port), zap.Int("privoxy", privoxy.port))
-	_log.Info("proxy started")
-
-	// notify HAProxy of the new backend
-	ha.AddBackend(ctx, privoxy.port)
-
-	// let the processes run until they terminate
-	go tor.Wait()
-	go privoxy.Wait()
-
-	// TODO periodically check that this proxy is still functional
-	// wait for any of the following events to occur
-	select {
-	case <-ctx.Done():
-		// application terminating
-	case <-tor.Done():
-		// tor ended
-	case <-privoxy.Done():
-		// privoxy ended
-	case <-time.After(time.Duration(*maxProxyTime) * time.Second):
-		// proxy lifetime expired
+	ctx := SignalContext()
+	if err := m.Start(ctx); err != nil {
+		log.Fatal("failed to start", zap.Error(err))
 	}
 
-	// tell HAProxy to remove this backend
-	ha.RemoveBackend(ctx, privoxy.port)
+	go ReloadOnHUP(m)
+	go RecycleOnUSR1(ctx, m)
+	go UpgradeOnUSR2(ctx, m)
 
-	// clean up after ourselves
-	_log.Info("stopping proxy")
-	privoxy.Close()
-	tor.Close()
+	// clean up once the application is terminating
+	m.Wait()
+	m.Stop()
 
-	// release the port for later use
-	unmapPorts(tor.port, privoxy.port)
-	_log.Info("proxy terminated")
+	log.Info("done")
 }
 
-// SignalContext creates a new context that will be canceled when the program receives certain termination signals.
+// SignalContext creates a new context that will be canceled when the program receives certain termination signals, or
+// once it has been running for -max-runtime, whichever comes first.
 func SignalContext() context.Context {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	// handle termination signals
 	terminate := make(chan os.Signal, 1)
-	signal.Notify(terminate, os.Kill, os.Interrupt)
+	signal.Notify(terminate, os.Kill, os.Interrupt, syscall.SIGTERM)
+
+	var expired <-chan time.Time
+	if *maxRuntime > 0 {
+		expired = time.After(*maxRuntime)
+	}
 
 	go func() {
-		<-terminate
+		select {
+		case sig := <-terminate:
+			log.Info("got signal; shutting down", zap.String("signal", sig.String()))
+		case <-expired:
+			log.Info("maximum runtime reached; shutting down", zap.Duration("max_runtime", *maxRuntime))
+		}
 		cancel()
 	}()
 
 	return ctx
 }
 
-// ReloadOnHUP waits to receive a SIGHUP signal, at which point HAProxy will reload its configuration.
-func ReloadOnHUP(ctx context.Context, ha *HAProxy) {
+// ReloadOnHUP waits to receive a SIGHUP signal, at which point the log file is reopened, the config file is read again
+// and every HAProxy will reload its configuration.
+func ReloadOnHUP(m *torotator.Manager) {
 	hup := make(chan os.Signal, 1)
 	signal.Notify(hup, syscall.SIGHUP)
 
 	go func() {
 		for _ = range hup {
 			log.Info("got sighup; reloading config")
-			ha.Reload(ctx)
+			if logFile != nil {
+				if err := logFile.Reopen(); err != nil {
+					log.Error("unable to reopen log file", zap.String("path", logFile.name), zap.Error(err))
+				}
+			}
+
+			// backends are untouched, so every current backend carries over to the new config
+			if err := ReloadConfig(flag.CommandLine, m); err != nil {
+				log.Error("unable to reload config file; keeping current settings", zap.Error(err))
+			}
+		}
+	}()
+}
+
+// RecycleOnUSR1 waits to receive a SIGUSR1 signal, at which point every proxy in every pool is recycled so that fresh
+// circuits are built.
+func RecycleOnUSR1(ctx context.Context, m *torotator.Manager) {
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+
+	go func() {
+		for range usr1 {
+			log.Info("got sigusr1; recycling proxies")
+			go m.RecycleAll(ctx)
+		}
+	}()
+}
+
+// UpgradeOnUSR2 waits to receive a SIGUSR2 signal, at which point a new torotator is started from the current binary
+// to take over from this one.
+func UpgradeOnUSR2(ctx context.Context, m *torotator.Manager) {
+	usr2 := make(chan os.Signal, 1)
+	signal.Notify(usr2, syscall.SIGUSR2)
+
+	go func() {
+		for range usr2 {
+			log.Info("got sigusr2; handing off to a new process")
+			if err := m.HandOff(ctx); err != nil {
+				log.Error("upgrade failed; carrying on", zap.Error(err))
+			}
 		}
 	}()
 }
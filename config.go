@@ -0,0 +1,432 @@
+package torotator
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/uber-go/zap"
+)
+
+// Config holds every setting torotator runs with. Each field corresponds to the command-line flag named next to it,
+// whose usage describes it in full. Once a Manager is using a Config, it must not change; Manager.Reload takes a new one
+// for the settings that may change while running.
+type Config struct {
+	ProxyPort            int           // -p
+	BindAddress          string        // -bind
+	TorCount             int           // -c
+	TLSCert              string        // -tls-cert
+	TLSKey               string        // -tls-key
+	Allow                string        // -allow
+	FanoutInterval       time.Duration // -fanout-interval
+	DirectRatio          float64       // -direct-ratio
+	EntryNodes           string        // -entry-nodes
+	ExitCountries        string        // -exit-countries
+	PortRangeStart       int           // -s
+	PortRangeEnd         int           // -e
+	PortList             string        // -ports
+	MaxProxyTime         int           // -m
+	CircuitInfo          bool          // -circuit-info
+	RotationStrategy     string        // -rotation-strategy
+	Once                 bool          // -once
+	LifetimeJitter       int           // -jitter
+	MinHealthy           int           // -min-healthy
+	MinHealthyWait       time.Duration // -min-healthy-wait
+	LiveTimeout          time.Duration // -live-timeout
+	WarmupTime           int           // -warmup
+	SocksFlags           string        // -socks-flags
+	IsolateSOCKSAuth     bool          // -isolate-socks-auth
+	WarmSpares           int           // -warm-spares
+	BootstrapConcurrency int           // -bootstrap-concurrency
+	BootstrapTimeout     time.Duration // -bootstrap-timeout
+	StartupOrder         string        // -startup-order
+	StartupStagger       time.Duration // -startup-stagger
+	ReplaceInterval      time.Duration // -replace-interval
+	RecycleStagger       time.Duration // -recycle-stagger
+	HAProxyAttempts      int           // -haproxy-attempts
+	TorAttempts          int           // -tor-attempts
+	SharedCache          bool          // -tor-cache
+	TorCacheRefresh      time.Duration // -tor-cache-refresh
+	SocksPorts           int           // -socks-ports
+	TorSocket            bool          // -tor-unix-socket
+	UpstreamProxy        string        // -upstream-proxy
+	UpstreamProxyAuth    string        // -upstream-proxy-auth
+	TorLogLevel          string        // -tor-log-level
+	CircuitTime          int           // -t
+	CircuitDirtiness     int           // -circuit-dirtiness
+	TimeoutConnect       time.Duration // -timeout-connect
+	TimeoutClient        time.Duration // -timeout-client
+	BackendKeepAlive     string        // -backend-keep-alive
+	BackendKeepAliveTime time.Duration // -backend-keep-alive-timeout
+	TimeoutServer        time.Duration // -timeout-server
+	ReloadDelay          time.Duration // -reload-delay
+	ReloadMaxDelay       time.Duration // -reload-max-delay
+	ReloadTimeout        time.Duration // -reload-timeout
+	Retries              int           // -retries
+	Redispatch           bool          // -redispatch
+	MaxConn              int           // -maxconn
+	DefaultMaxConn       int           // -defaults-maxconn
+	ServerMaxConn        int           // -server-maxconn
+	ForwardedFor         string        // -forwarded-for
+	Anonymize            bool          // -anonymize
+	HealthPath           string        // -health-path
+	StickyTTL            time.Duration // -sticky
+	HAProxyUser          string        // -haproxy-user
+	HAProxyGroup         string        // -haproxy-group
+	HAProxyConfigOut     string        // -haproxy-config-out
+	HAProxyExtraFile     string        // -haproxy-extra
+	HAProxyMaxProcs      int           // -haproxy-max-procs
+	HAProxyMasterWorker  bool          // -haproxy-master-worker
+	HAProxyLog           string        // -haproxy-log
+	StatsPort            int           // -stats
+	StatsConflict        string        // -stats-conflict
+	StatsInterval        time.Duration // -stats-interval
+	IPv6                 bool          // -ipv6
+	HealthInterval       time.Duration // -health-interval
+	HealthFailures       int           // -health-failures
+	ExitCooldown         time.Duration // -exit-cooldown
+	CheckURL             string        // -check-url
+	CheckTimeout         time.Duration // -check-timeout
+	PrivoxyBufferLimit   int           // -privoxy-buffer-limit
+	PrivoxyKeepAlive     time.Duration // -privoxy-keep-alive-timeout
+	PrivoxySocketTimeout time.Duration // -privoxy-socket-timeout
+	StatusFile           string        // -status-file
+	HAProxyBin           string        // -haproxy-bin
+	PrivoxyBin           string        // -privoxy-bin
+	TorBin               string        // -tor-bin
+	EventsFile           string        // -events
+	MaxOpenFiles         int           // -max-open-files
+	MaxMemory            int           // -max-memory
+	Cgroup               string        // -cgroup
+	StartupWait          time.Duration // -startup-wait
+	DataDir              string        // -data-dir
+	AdminAddr            string        // -admin
+	DrainTimeout         time.Duration // -drain-timeout
+	PprofPort            int           // -pprof-port
+	Seed                 int64         // -seed
+	Debug                bool          // -debug
+	DryRun               bool          // -dry-run
+	Pools                PoolList      // -pool; without any, a single pool is built from ProxyPort, TorCount and ExitCountries
+	KeepData             KeepData      // -keep-data
+
+	// Log receives everything torotator and the services it runs have to say.
+	Log zap.Logger
+}
+
+// DefaultConfig returns a Config with the same defaults as the command-line flags.
+func DefaultConfig() *Config {
+	return &Config{
+		ProxyPort:            8080,
+		BindAddress:          "*",
+		TorCount:             3,
+		PortRangeStart:       30000,
+		PortRangeEnd:         65535,
+		MaxProxyTime:         900,
+		RotationStrategy:     "timed",
+		MinHealthyWait:       2 * time.Minute,
+		LiveTimeout:          2 * time.Minute,
+		WarmupTime:           30,
+		IsolateSOCKSAuth:     true,
+		WarmSpares:           1,
+		BootstrapTimeout:     60 * time.Second,
+		StartupOrder:         "sequential",
+		StartupStagger:       time.Second,
+		RecycleStagger:       5 * time.Second,
+		HAProxyAttempts:      5,
+		TorAttempts:          10,
+		TorCacheRefresh:      time.Hour,
+		SocksPorts:           1,
+		CircuitTime:          120,
+		TimeoutConnect:       5 * time.Second,
+		TimeoutClient:        30 * time.Second,
+		BackendKeepAlive:     "server-close",
+		BackendKeepAliveTime: 3 * time.Second,
+		TimeoutServer:        30 * time.Second,
+		ReloadDelay:          2 * time.Second,
+		ReloadMaxDelay:       30 * time.Second,
+		ReloadTimeout:        30 * time.Second,
+		Retries:              3,
+		Redispatch:           true,
+		MaxConn:              256,
+		ForwardedFor:         "strip",
+		Anonymize:            true,
+		HealthPath:           "/torotator-health",
+		HAProxyLog:           "none",
+		StatsConflict:        "fail",
+		StatsInterval:        time.Minute,
+		HealthFailures:       3,
+		ExitCooldown:         time.Hour,
+		CheckURL:             "https://check.torproject.org/api/ip",
+		CheckTimeout:         30 * time.Second,
+		PrivoxyBufferLimit:   4096,
+		PrivoxyKeepAlive:     5 * time.Second,
+		PrivoxySocketTimeout: 300 * time.Second,
+		HAProxyBin:           "haproxy",
+		PrivoxyBin:           "privoxy",
+		TorBin:               "tor",
+		StartupWait:          250 * time.Millisecond,
+		DataDir:              "/tmp/torotator",
+		DrainTimeout:         5 * time.Minute,
+
+		KeepData: make(KeepData),
+		Log:      zap.New(zap.NewJSONEncoder(zap.RFC3339Formatter("time"))),
+	}
+}
+
+// cfg holds the settings of the Manager, of which there is at most one per process. Until NewManager is called, it holds
+// the defaults.
+var cfg = DefaultConfig()
+
+// Validate checks that the settings make sense before anything is started. An empty TorLogLevel is filled in to match
+// Debug.
+func (c *Config) Validate() error {
+	if c.BindAddress != "*" && net.ParseIP(c.BindAddress) == nil {
+		return fmt.Errorf("bind address %q is not a valid IP address", c.BindAddress)
+	}
+
+	switch c.TorLogLevel {
+	case "":
+		// pick a level that matches our own verbosity
+		c.TorLogLevel = "warn"
+		if c.Debug {
+			c.TorLogLevel = "notice"
+		}
+	case "err", "warn", "notice", "info", "debug":
+	default:
+		return fmt.Errorf("unknown Tor log level %q", c.TorLogLevel)
+	}
+
+	switch c.HAProxyLog {
+	case "none", "http", "tcp":
+	default:
+		return fmt.Errorf("unknown haproxy-log mode %q", c.HAProxyLog)
+	}
+
+	switch c.BackendKeepAlive {
+	case "server-close", "keep-alive", "reuse":
+	default:
+		return fmt.Errorf("unknown backend-keep-alive mode %q", c.BackendKeepAlive)
+	}
+
+	if c.BackendKeepAliveTime <= 0 {
+		return fmt.Errorf("backend-keep-alive-timeout must be positive, got %s", c.BackendKeepAliveTime)
+	}
+
+	switch c.StatsConflict {
+	case "fail", "next", "disable":
+	default:
+		return fmt.Errorf("unknown stats-conflict mode %q", c.StatsConflict)
+	}
+
+	switch c.ForwardedFor {
+	case "strip", "preserve", "append":
+	default:
+		return fmt.Errorf("unknown forwarded-for mode %q", c.ForwardedFor)
+	}
+
+	if c.MaxConn <= 0 {
+		return fmt.Errorf("maxconn must be positive, got %d", c.MaxConn)
+	}
+
+	if c.HealthInterval < 0 || c.ExitCooldown < 0 {
+		return fmt.Errorf("health-interval and exit-cooldown must not be negative")
+	}
+
+	if c.HealthFailures <= 0 {
+		return fmt.Errorf("health-failures must be positive, got %d", c.HealthFailures)
+	}
+
+	switch c.RotationStrategy {
+	case "timed", "manual":
+	case "per-request":
+		// a fan-out pool's requests can't be told apart by Tor instance
+		if c.FanoutInterval > 0 {
+			return fmt.Errorf("the per-request rotation strategy can't be combined with fanout-interval")
+		}
+	default:
+		return fmt.Errorf("unknown rotation strategy %q", c.RotationStrategy)
+	}
+
+	switch c.StartupOrder {
+	case "sequential", "parallel":
+	default:
+		return fmt.Errorf("unknown startup order %q", c.StartupOrder)
+	}
+
+	if (c.MaxOpenFiles != 0 || c.MaxMemory != 0 || c.Cgroup != "") && !LIMITS_SUPPORTED {
+		return fmt.Errorf("max-open-files, max-memory and cgroup are only supported on Linux")
+	}
+
+	if c.MaxOpenFiles < 0 || c.MaxMemory < 0 {
+		return fmt.Errorf("max-open-files and max-memory must not be negative")
+	}
+
+	// HAProxy needs a descriptor for each side of every connection
+	if c.MaxOpenFiles > 0 && c.MaxOpenFiles < 2*c.MaxConn+HAPROXY_SPARE_FILES {
+		return fmt.Errorf("max-open-files must be at least %d for a maxconn of %d", 2*c.MaxConn+HAPROXY_SPARE_FILES, c.MaxConn)
+	}
+
+	if c.Cgroup != "" {
+		if _, err := os.Stat(path.Join(c.Cgroup, "cgroup.procs")); err != nil {
+			return fmt.Errorf("cgroup %s is not usable: %v", c.Cgroup, err)
+		}
+	}
+
+	if c.SocksPorts < 1 {
+		return fmt.Errorf("socks-ports must be at least 1, got %d", c.SocksPorts)
+	}
+
+	// every SocksPort shares the Tor's Unix socket directory, control port and fan-out target
+	if c.SocksPorts > 1 && (c.TorSocket || c.FanoutInterval > 0 || c.RotationStrategy == "per-request") {
+		return fmt.Errorf("socks-ports can't be combined with tor-unix-socket, fanout-interval or the per-request rotation strategy")
+	}
+
+	if c.TorCacheRefresh <= 0 {
+		return fmt.Errorf("tor-cache-refresh must be positive, got %s", c.TorCacheRefresh)
+	}
+
+	if c.StartupStagger < 0 {
+		return fmt.Errorf("startup-stagger must not be negative, got %s", c.StartupStagger)
+	}
+
+	// a reload needs room for the new process alongside the current one
+	if c.HAProxyMaxProcs != 0 && c.HAProxyMaxProcs < 2 {
+		return fmt.Errorf("haproxy-max-procs must be 0 or at least 2, got %d", c.HAProxyMaxProcs)
+	}
+
+	if c.LiveTimeout < 0 {
+		return fmt.Errorf("live-timeout must not be negative, got %s", c.LiveTimeout)
+	}
+
+	if c.ReplaceInterval < 0 {
+		return fmt.Errorf("replace-interval must not be negative, got %s", c.ReplaceInterval)
+	}
+
+	if c.HAProxyAttempts <= 0 {
+		return fmt.Errorf("haproxy-attempts must be positive, got %d", c.HAProxyAttempts)
+	}
+
+	if c.TorCount <= 0 {
+		return fmt.Errorf("number of Tor nodes must be positive, got %d", c.TorCount)
+	}
+
+	if c.CircuitTime <= 0 {
+		return fmt.Errorf("circuit time must be positive, got %d", c.CircuitTime)
+	}
+
+	if c.CircuitDirtiness < 0 {
+		return fmt.Errorf("circuit-dirtiness must be positive, got %d", c.CircuitDirtiness)
+	}
+
+	if c.Retries < 0 {
+		return fmt.Errorf("retries must not be negative, got %d", c.Retries)
+	}
+
+	if c.LifetimeJitter < 0 {
+		return fmt.Errorf("jitter must not be negative, got %d", c.LifetimeJitter)
+	}
+
+	if c.WarmSpares < 0 {
+		return fmt.Errorf("warm-spares must not be negative, got %d", c.WarmSpares)
+	}
+
+	if c.BootstrapConcurrency < 0 {
+		return fmt.Errorf("bootstrap-concurrency must not be negative, got %d", c.BootstrapConcurrency)
+	}
+
+	if c.HealthPath != "" && (!strings.HasPrefix(c.HealthPath, "/") || strings.ContainsAny(c.HealthPath, " \t")) {
+		return fmt.Errorf("health-path must start with / and contain no spaces, got %q", c.HealthPath)
+	}
+
+	if c.UpstreamProxy != "" {
+		if _, _, err := net.SplitHostPort(c.UpstreamProxy); err != nil {
+			return fmt.Errorf("upstream-proxy must be host:port, got %q", c.UpstreamProxy)
+		}
+	}
+
+	if c.UpstreamProxyAuth != "" && !strings.Contains(c.UpstreamProxyAuth, ":") {
+		return fmt.Errorf("upstream-proxy-auth must be user:password")
+	}
+
+	if c.DirectRatio < 0 || c.DirectRatio > 1 {
+		return fmt.Errorf("direct-ratio must be between 0 and 1, got %g", c.DirectRatio)
+	}
+
+	if c.FanoutInterval < 0 {
+		return fmt.Errorf("fanout-interval must not be negative, got %s", c.FanoutInterval)
+	}
+
+	// both work on Privoxy backends, of which a fan-out pool only has one
+	if c.FanoutInterval > 0 && (c.DirectRatio > 0 || c.MinHealthy > 0) {
+		return fmt.Errorf("fanout-interval can't be combined with direct-ratio or min-healthy")
+	}
+
+	if c.PrivoxyBufferLimit <= 0 {
+		return fmt.Errorf("privoxy-buffer-limit must be positive, got %d", c.PrivoxyBufferLimit)
+	}
+
+	if c.AdminAddr != "" {
+		if _, _, err := net.SplitHostPort(c.AdminAddr); err != nil {
+			return fmt.Errorf("admin must be host:port, got %q", c.AdminAddr)
+		}
+	}
+
+	if c.PprofPort < 0 || c.PprofPort > 65535 {
+		return fmt.Errorf("pprof-port must be a valid port, got %d", c.PprofPort)
+	}
+
+	if c.MinHealthy < 0 {
+		return fmt.Errorf("min-healthy must not be negative, got %d", c.MinHealthy)
+	}
+
+	if c.StickyTTL < 0 {
+		return fmt.Errorf("sticky must not be negative, got %s", c.StickyTTL)
+	}
+
+	if c.TLSKey != "" && c.TLSCert == "" {
+		return fmt.Errorf("tls-key requires tls-cert")
+	}
+
+	if c.TLSCert != "" {
+		// the key may live alongside the certificate, which is how HAProxy would take it anyway
+		key := c.TLSKey
+		if key == "" {
+			key = c.TLSCert
+		}
+
+		if _, err := tls.LoadX509KeyPair(c.TLSCert, key); err != nil {
+			return fmt.Errorf("unable to load TLS certificate: %v", err)
+		}
+	}
+
+	timeouts := map[string]time.Duration{
+		"timeout-connect":            c.TimeoutConnect,
+		"timeout-client":             c.TimeoutClient,
+		"timeout-server":             c.TimeoutServer,
+		"startup-wait":               c.StartupWait,
+		"check-timeout":              c.CheckTimeout,
+		"privoxy-keep-alive-timeout": c.PrivoxyKeepAlive,
+		"privoxy-socket-timeout":     c.PrivoxySocketTimeout,
+		"min-healthy-wait":           c.MinHealthyWait,
+		"reload-delay":               c.ReloadDelay,
+	}
+	for name, d := range timeouts {
+		if d <= 0 {
+			return fmt.Errorf("%s must be a positive duration, got %s", name, d)
+		}
+	}
+
+	if c.ReloadTimeout <= c.StartupWait {
+		return fmt.Errorf("reload-timeout must be longer than startup-wait (%s), got %s", c.StartupWait, c.ReloadTimeout)
+	}
+
+	if c.ReloadMaxDelay < c.ReloadDelay {
+		return fmt.Errorf("reload-max-delay must be at least reload-delay (%s), got %s", c.ReloadDelay, c.ReloadMaxDelay)
+	}
+
+	return nil
+}
@@ -0,0 +1,372 @@
+package torotator
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/uber-go/zap"
+)
+
+// CONTROL_TIMEOUT is how long a single exchange with Tor's control port may take.
+const CONTROL_TIMEOUT = 10 * time.Second
+
+// NEWNYM_INTERVAL is how often Tor honors NEWNYM; it ignores the signal if sent more often.
+const NEWNYM_INTERVAL = 10 * time.Second
+
+// useControl reports whether Tor instances need a control port.
+func useControl() bool {
+	return cfg.RotationStrategy == "per-request" || cfg.CircuitInfo
+}
+
+// Control is a connection to the control port of a Tor instance, which listens on a Unix socket in its data directory
+// and authenticates with a cookie.
+type Control struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// DialControl connects to the control port of t and authenticates.
+func DialControl(t *Tor) (c *Control, err error) {
+	conn, err := net.DialTimeout("unix", t.control, CONTROL_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+
+	c = &Control{conn: conn, r: bufio.NewReader(conn)}
+
+	cookie, err := os.ReadFile(path.Join(t.dir, "control_auth_cookie"))
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	if _, err = c.Command("AUTHENTICATE " + hex.EncodeToString(cookie)); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("unable to authenticate: %v", err)
+	}
+
+	return c, nil
+}
+
+// Command sends cmd and returns the lines of Tor's reply, without their status codes. A reply other than 250 is an
+// error.
+func (c *Control) Command(cmd string) (lines []string, err error) {
+	c.conn.SetDeadline(time.Now().Add(CONTROL_TIMEOUT))
+
+	if _, err = fmt.Fprintf(c.conn, "%s\r\n", cmd); err != nil {
+		return nil, err
+	}
+
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		if len(line) < 4 {
+			return nil, fmt.Errorf("malformed reply %q", line)
+		}
+
+		if !strings.HasPrefix(line, "250") {
+			return nil, fmt.Errorf("%s", line)
+		}
+
+		lines = append(lines, line[4:])
+
+		// "250+" is followed by data lines up to a lone ".", which are part of the same reply
+		if line[3] == '+' {
+			if lines, err = c.readData(lines); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// "250 " ends the reply, while "250-" and "250+" continue it
+		if line[3] == ' ' {
+			return lines, nil
+		}
+	}
+}
+
+// readData appends the data lines of a "250+" reply to lines, up to the lone "." that ends them.
+func (c *Control) readData(lines []string) ([]string, error) {
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		if line == "." {
+			return lines, nil
+		}
+
+		// a leading dot is doubled so that it can't be mistaken for the end
+		lines = append(lines, strings.TrimPrefix(line, "."))
+	}
+}
+
+// Relay is a single hop of a circuit. Only the exit's address and country are looked up.
+type Relay struct {
+	Fingerprint string `json:"fingerprint"`
+	Nickname    string `json:"nickname,omitempty"`
+	Address     string `json:"address,omitempty"`
+	Country     string `json:"country,omitempty"`
+}
+
+// Circuit is the path a circuit takes, from the guard to the exit.
+type Circuit struct {
+	ID   int     `json:"id"`
+	Path []Relay `json:"path"`
+}
+
+// Exit returns the last hop of the circuit.
+func (c *Circuit) Exit() *Relay {
+	return &c.Path[len(c.Path)-1]
+}
+
+// String describes the path as "guard > middle > exit", by nickname where known.
+func (c *Circuit) String() string {
+	var hops []string
+	for _, r := range c.Path {
+		name := r.Nickname
+		if name == "" {
+			name = r.Fingerprint
+		}
+		hops = append(hops, name)
+	}
+
+	return strings.Join(hops, " > ")
+}
+
+// Circuit returns the newest general-purpose circuit Tor has built, along with the address and country of its exit, or
+// nil if there isn't one yet.
+func (c *Control) Circuit() (circ *Circuit, err error) {
+	lines, err := c.Command("GETINFO circuit-status")
+	if err != nil {
+		return nil, err
+	}
+
+	// a single circuit comes on the same line as the key, several as data lines after it
+	for _, line := range lines {
+		if parsed := parseCircuit(strings.TrimPrefix(line, "circuit-status=")); parsed != nil && (circ == nil || parsed.ID > circ.ID) {
+			circ = parsed
+		}
+	}
+
+	if circ == nil {
+		return nil, nil
+	}
+
+	exit := circ.Exit()
+	if exit.Address, err = c.relayAddress(exit.Fingerprint); err != nil {
+		return nil, err
+	}
+
+	// Tor only knows countries when it has its GeoIP database
+	if lines, err = c.Command("GETINFO ip-to-country/" + exit.Address); err == nil && len(lines) > 0 {
+		if eq := strings.Index(lines[0], "="); eq >= 0 {
+			exit.Country = lines[0][eq+1:]
+		}
+	}
+
+	return circ, nil
+}
+
+// relayAddress looks up the IP address of the relay with fingerprint in Tor's copy of the consensus.
+func (c *Control) relayAddress(fingerprint string) (string, error) {
+	lines, err := c.Command("GETINFO ns/id/" + fingerprint)
+	if err != nil {
+		return "", err
+	}
+
+	// r nickname identity digest date time IP ORPort DirPort
+	for _, line := range lines {
+		if f := strings.Fields(line); len(f) >= 7 && f[0] == "r" {
+			return f[6], nil
+		}
+	}
+
+	return "", fmt.Errorf("no address for relay %s", fingerprint)
+}
+
+// parseCircuit parses one line of "GETINFO circuit-status", such as
+// "5 BUILT $AAAA~guard,$BBBB~middle,$CCCC~exit BUILD_FLAGS=NEED_CAPACITY PURPOSE=GENERAL ...", returning nil for
+// anything but a built, general-purpose circuit.
+func parseCircuit(line string) *Circuit {
+	f := strings.Fields(line)
+	if len(f) < 4 || f[1] != "BUILT" {
+		return nil
+	}
+
+	general := false
+	for _, kv := range f[3:] {
+		if kv == "PURPOSE=GENERAL" {
+			general = true
+		}
+	}
+
+	id, err := strconv.Atoi(f[0])
+	if err != nil || !general {
+		return nil
+	}
+
+	circ := &Circuit{ID: id}
+	for _, hop := range strings.Split(f[2], ",") {
+		// older versions separate the nickname with "=" rather than "~"
+		fp, nick := hop, ""
+		if i := strings.IndexAny(hop, "~="); i >= 0 {
+			fp, nick = hop[:i], hop[i+1:]
+		}
+		circ.Path = append(circ.Path, Relay{Fingerprint: strings.TrimPrefix(fp, "$"), Nickname: nick})
+	}
+
+	return circ
+}
+
+// Signal sends a signal such as NEWNYM to Tor.
+func (c *Control) Signal(name string) error {
+	_, err := c.Command("SIGNAL " + name)
+	return err
+}
+
+// Close closes the connection.
+func (c *Control) Close() error {
+	return c.conn.Close()
+}
+
+// NewCircuitPerRequest asks tor for new circuits whenever HAProxy has sent requests to the backend on port since the last
+// time, until ctx is canceled or Tor exits. Tor honors NEWNYM at most every NEWNYM_INTERVAL, so requests arriving closer
+// together than that still share a circuit.
+func NewCircuitPerRequest(ctx context.Context, _log zap.Logger, ha *HAProxy, port int, tor *Tor) {
+	t := time.NewTicker(NEWNYM_INTERVAL)
+	defer t.Stop()
+
+	var (
+		c    *Control
+		seen int64
+	)
+	defer func() {
+		if c != nil {
+			c.Close()
+		}
+	}()
+
+	server := fmt.Sprintf("privoxy-%d", port)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tor.Done():
+			return
+		case <-t.C:
+		}
+
+		stats, err := ha.BackendStats()
+		if err != nil {
+			continue
+		}
+
+		var sessions int64
+		for _, s := range stats {
+			if s.Server == server {
+				sessions = s.TotalSessions
+			}
+		}
+
+		// HAProxy's counters start over when it reloads
+		if sessions == seen || sessions == 0 {
+			seen = sessions
+			continue
+		}
+		seen = sessions
+
+		if c == nil {
+			if c, err = DialControl(tor); err != nil {
+				_log.Warn("unable to reach tor control port", zap.Error(err))
+				continue
+			}
+		}
+
+		if err = c.Signal("NEWNYM"); err != nil {
+			_log.Warn("failed to request new circuits", zap.Error(err))
+			c.Close()
+			c = nil
+			continue
+		}
+
+		_log.Debug("requested new circuits", zap.Int64("sessions", sessions))
+		events.Emit(Event{Event: EVENT_CIRCUIT_ROTATED, Proxy: tor.proxy, Tor: tor.port, Privoxy: port})
+	}
+}
+
+// CIRCUIT_INTERVAL is how often -circuit-info checks whether a proxy's circuit has changed.
+const CIRCUIT_INTERVAL = 15 * time.Second
+
+// TrackCircuit logs the path of tor's newest circuit whenever it changes, and records it in the status of the backend
+// on port, until ctx is canceled or Tor exits.
+func TrackCircuit(ctx context.Context, _log zap.Logger, ha *HAProxy, port int, tor *Tor) {
+	t := time.NewTicker(CIRCUIT_INTERVAL)
+	defer t.Stop()
+
+	var (
+		c    *Control
+		last int
+	)
+	defer func() {
+		if c != nil {
+			c.Close()
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tor.Done():
+			return
+		case <-t.C:
+		}
+
+		var err error
+		if c == nil {
+			if c, err = DialControl(tor); err != nil {
+				_log.Debug("unable to reach tor control port", zap.Error(err))
+				continue
+			}
+		}
+
+		circ, err := c.Circuit()
+		if err != nil {
+			_log.Warn("unable to fetch circuit", zap.Error(err))
+			c.Close()
+			c = nil
+			continue
+		}
+
+		// nothing built yet, or the same circuit as last time
+		if circ == nil || circ.ID == last {
+			continue
+		}
+		last = circ.ID
+
+		exit := circ.Exit()
+		_log.Info("circuit",
+			zap.Int("circuit", circ.ID),
+			zap.String("path", circ.String()),
+			zap.String("exit", exit.Nickname),
+			zap.String("exit_ip", exit.Address),
+			zap.String("exit_country", exit.Country))
+
+		ha.SetCircuit(port, circ)
+	}
+}
@@ -0,0 +1,125 @@
+package torotator
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/uber-go/zap"
+)
+
+// versionRE finds the version number in the output of a program's version command, such as "HAProxy version 2.4.22"
+// or "Tor version 0.4.8.9."
+var versionRE = regexp.MustCompile(`(?i)version (\d+(?:\.\d+)*)`)
+
+// VERSION_TIMEOUT is how long a program may take to report its version.
+const VERSION_TIMEOUT = 10 * time.Second
+
+// Dependency is an external program torotator runs, along with the oldest version that supports everything torotator
+// asks of it.
+type Dependency struct {
+	Name string
+	Bin  string
+	Args []string
+	Min  string
+}
+
+// Dependencies returns every program torotator needs.
+func Dependencies() []Dependency {
+	// del-header, the runtime API's "set weight" and stick tables
+	haproxyMin := "1.5"
+	if cfg.BackendKeepAlive == "reuse" {
+		// http-reuse
+		haproxyMin = "1.6"
+	}
+	if cfg.HAProxyMasterWorker {
+		// the master CLI socket
+		haproxyMin = "1.9"
+	}
+	if cfg.HealthPath != "" {
+		// http-request return
+		haproxyMin = "2.2"
+	}
+
+	return []Dependency{
+		{Name: "haproxy", Bin: cfg.HAProxyBin, Args: []string{"-v"}, Min: haproxyMin},
+		// hide-accept-language and forward-socks5t
+		{Name: "privoxy", Bin: cfg.PrivoxyBin, Args: []string{"--version"}, Min: "3.0.21"},
+		// --allow-missing-torrc, IPv6Traffic and SocksPort flags
+		{Name: "tor", Bin: cfg.TorBin, Args: []string{"--version"}, Min: "0.2.9"},
+	}
+}
+
+// Check runs the program to find its version and makes sure it's recent enough, returning the version it found.
+func (d Dependency) Check() (version string, err error) {
+	if _, err = exec.LookPath(d.Bin); err != nil {
+		return "", fmt.Errorf("%s not found; install it or point torotator at it with -%s-bin", d.Bin, d.Name)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), VERSION_TIMEOUT)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, d.Bin, d.Args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%s %s failed: %v", d.Bin, strings.Join(d.Args, " "), err)
+	}
+
+	m := versionRE.FindSubmatch(out)
+	if m == nil {
+		return "", fmt.Errorf("unable to determine the version of %s from %q", d.Bin, firstLine(out))
+	}
+
+	version = string(m[1])
+	if compareVersions(version, d.Min) < 0 {
+		return version, fmt.Errorf("%s %s is too old; torotator needs %s or newer", d.Name, version, d.Min)
+	}
+
+	return version, nil
+}
+
+// compareVersions compares two dotted version numbers, returning -1, 0 or 1 when a is older than, the same as, or newer
+// than b. Missing components count as zero.
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+
+	return 0
+}
+
+// firstLine returns the first line of out, for error messages.
+func firstLine(out []byte) string {
+	return strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0])
+}
+
+// FindDependencies makes sure every required program is installed, runs, and is new enough.
+func FindDependencies() error {
+	for _, dep := range Dependencies() {
+		version, err := dep.Check()
+		if err != nil {
+			return fmt.Errorf("unusable required program %s: %v", dep.Bin, err)
+		}
+
+		log.Debug("found required program", zap.String("name", dep.Bin), zap.String("version", version))
+	}
+
+	return nil
+}
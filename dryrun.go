@@ -0,0 +1,61 @@
+package torotator
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// DryRun renders the configuration torotator would use without launching any processes: the HAProxy config with a
+// sample set of backends, and the Privoxy config and Tor command line for a single proxy.
+func (m *Manager) DryRun(w io.Writer) error {
+	// each proxy consumes one port for Tor followed by one for Privoxy
+	next := 0
+	for _, pool := range m.pools {
+		ha, err := ConfigureHAProxy(pool)
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i < pool.Count; i++ {
+			ha.Backends[samplePort(next+1)] = &Backend{Weight: FULL_WEIGHT}
+			next += 2
+		}
+
+		fmt.Fprintf(w, "# HAProxy: %s\n", ha.conf)
+		if err = ha.Render(w); err != nil {
+			return err
+		}
+		fmt.Fprintln(w)
+	}
+
+	tor := &Tor{countries: m.pools[0].ExitCountries()}
+	tor.Configure(samplePort(0))
+	for i := 1; i < cfg.SocksPorts; i++ {
+		tor.extraPorts = append(tor.extraPorts, samplePort(i))
+	}
+
+	privoxy := &Privoxy{tor: tor}
+	privoxy.Configure(samplePort(cfg.SocksPorts))
+
+	fmt.Fprintf(w, "# Privoxy: %s\n", privoxy.conf)
+	if err := privoxy.Render(w); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "\n# Privoxy actions: %s\n", privoxy.actions)
+	fmt.Fprint(w, privoxy.Actions())
+
+	fmt.Fprintf(w, "\n# Tor\n%s %s\n", cfg.TorBin, strings.Join(tor.Args(), " "))
+
+	return nil
+}
+
+// samplePort returns the i-th port portPlz would hand out on an idle system.
+func samplePort(i int) int {
+	if len(pinnedPorts) > 0 {
+		return pinnedPorts[i%len(pinnedPorts)]
+	}
+
+	return cfg.PortRangeStart + i
+}
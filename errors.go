@@ -0,0 +1,61 @@
+package torotator
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+var (
+	// ErrTerminating is returned when something is abandoned because torotator is shutting down.
+	ErrTerminating = errors.New("application terminating")
+
+	// ErrProcessKilled matches an ExitError for a process that was killed, which is how every child process is
+	// stopped during cleanup.
+	ErrProcessKilled = errors.New("process was killed")
+
+	// ErrStartupTimeout is returned when a process doesn't start within the time allowed for it.
+	ErrStartupTimeout = errors.New("timed out starting process")
+
+	// ErrNotLive is returned by WaitLive when HAProxy doesn't report a new backend as up in time.
+	ErrNotLive = errors.New("backend never went live")
+
+	// ErrNoFreePort is returned by portPlz when every candidate port is either handed out or in use by something else.
+	ErrNoFreePort = errors.New("no free port")
+
+	// ErrBootstrapTimeout is returned when Tor doesn't finish bootstrapping within the bootstrap timeout.
+	ErrBootstrapTimeout = errors.New("tor did not bootstrap in time")
+
+	// ErrReloadTimeout is returned when a replacement HAProxy doesn't start within the reload timeout.
+	ErrReloadTimeout = fmt.Errorf("replacement haproxy: %w", ErrStartupTimeout)
+)
+
+// ExitError describes how a child process ended. It matches ErrProcessKilled with errors.Is if the process was killed.
+type ExitError struct {
+	State *os.ProcessState
+}
+
+// exitError converts the error from waiting on a process into an ExitError, if the process ran at all.
+func exitError(err error, state *os.ProcessState) error {
+	if err == nil || state == nil {
+		return err
+	}
+
+	return &ExitError{State: state}
+}
+
+func (e *ExitError) Error() string {
+	return e.State.String()
+}
+
+// Is reports whether target is ErrProcessKilled and the process was killed.
+func (e *ExitError) Is(target error) bool {
+	return target == ErrProcessKilled && e.Killed()
+}
+
+// Killed reports whether the process was ended by SIGKILL.
+func (e *ExitError) Killed() bool {
+	ws, ok := e.State.Sys().(syscall.WaitStatus)
+	return ok && ws.Signaled() && ws.Signal() == syscall.SIGKILL
+}
@@ -0,0 +1,85 @@
+package torotator
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/uber-go/zap"
+)
+
+const (
+	EVENT_PROXY_STARTED   = "proxy_started"
+	EVENT_PROXY_HEALTHY   = "proxy_healthy"
+	EVENT_PROXY_RECYCLED  = "proxy_recycled"
+	EVENT_BACKEND_ADDED   = "backend_added"
+	EVENT_BACKEND_REMOVED = "backend_removed"
+	EVENT_CIRCUIT_ROTATED = "circuit_rotated"
+)
+
+// Event is a single proxy lifecycle event, written as one line of JSON to the event log.
+type Event struct {
+	Event    string    `json:"event"`
+	Time     time.Time `json:"time"`
+	Port     int       `json:"port,omitempty"`
+	Proxy    int64     `json:"proxy,omitempty"`
+	Tor      int       `json:"tor,omitempty"`
+	Privoxy  int       `json:"privoxy,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+	Age      float64   `json:"age,omitempty"`
+	Direct   bool      `json:"direct,omitempty"`
+	BytesIn  int64     `json:"bytes_in,omitempty"`
+	BytesOut int64     `json:"bytes_out,omitempty"`
+	Circuit  string    `json:"circuit,omitempty"`
+}
+
+// EventLog is an append-only JSONL file of lifecycle events, intended for dashboards and auditing.
+type EventLog struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+// events is the destination for all lifecycle events. It is nil unless -events is set.
+var events *EventLog
+
+// OpenEventLog opens (or creates) the event log at name for appending.
+func OpenEventLog(name string) (e *EventLog, err error) {
+	e = new(EventLog)
+	if e.f, err = os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+		return nil, err
+	}
+
+	e.enc = json.NewEncoder(e.f)
+
+	return e, nil
+}
+
+// Emit timestamps and records an event. It is safe to call on a nil EventLog, in which case nothing happens.
+func (e *EventLog) Emit(ev Event) {
+	if e == nil {
+		return
+	}
+
+	ev.Time = time.Now().UTC()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := e.enc.Encode(ev); err != nil {
+		log.Warn("failed to write event", zap.String("event", ev.Event), zap.Error(err))
+	}
+}
+
+// Close closes the underlying file.
+func (e *EventLog) Close() error {
+	if e == nil {
+		return nil
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.f.Close()
+}
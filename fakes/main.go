@@ -0,0 +1,452 @@
+// Command fakes stands in for tor, privoxy and haproxy so that torotator can be run end to end without them. It
+// behaves like whichever program it is invoked as, going by the name of the executable, and does just enough for
+// torotator to manage it: reporting a version, writing its pid file, listening where it's told and logging in the real
+// program's format. Requests to the fake Privoxy and HAProxy get a short canned response.
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+func main() {
+	name := filepath.Base(os.Args[0])
+	args := os.Args[1:]
+
+	if len(args) > 0 && (args[0] == "--version" || args[0] == "-v") {
+		fmt.Println(map[string]string{
+			"tor":     "Tor version 0.4.8.9.",
+			"privoxy": "Privoxy version 3.0.34",
+			"haproxy": "HAProxy version 2.8.0 2023/05/31",
+		}[name])
+		return
+	}
+
+	var err error
+	switch name {
+	case "tor":
+		err = tor(args)
+	case "privoxy":
+		err = privoxy(args)
+	case "haproxy":
+		err = haproxy(args)
+	default:
+		err = fmt.Errorf("don't know how to behave like %q", name)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// opt returns the value following name in args, or "" if it isn't there.
+func opt(args []string, name string) string {
+	for i, a := range args {
+		if a == name && i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+
+	return ""
+}
+
+// opts returns the value of every occurrence of the option name in args.
+func opts(args []string, name string) (values []string) {
+	for i, a := range args {
+		if a == name && i+1 < len(args) {
+			values = append(values, args[i+1])
+		}
+	}
+
+	return values
+}
+
+// listen listens on a TCP address, or on a Unix socket when addr starts with "unix:".
+func listen(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, "unix:") {
+		return net.Listen("unix", strings.TrimPrefix(addr, "unix:"))
+	}
+
+	return net.Listen("tcp", addr)
+}
+
+// writePid records our pid in name, if given.
+func writePid(name string) error {
+	if name == "" {
+		return nil
+	}
+
+	return os.WriteFile(name, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
+
+// serve answers every HTTP request on l with body.
+func serve(l net.Listener, body string) {
+	http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, body)
+	}))
+}
+
+// waitForSignal blocks until we're asked to stop, returning the signal. HAProxy's soft stop, SIGUSR1, counts too.
+func waitForSignal() os.Signal {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR1)
+	return <-c
+}
+
+// SOFT_STOP_LINGER is how long the fake HAProxy carries on after a soft stop, standing in for the time HAProxy takes to
+// finish the connections it has.
+const SOFT_STOP_LINGER = 300 * time.Millisecond
+
+func tor(args []string) error {
+	torLog := func(level, msg string) {
+		fmt.Printf("%s [%s] %s\n", time.Now().Format("Jan _2 15:04:05.000"), level, msg)
+	}
+
+	ports := opts(args, "--SocksPort")
+	if len(ports) == 0 {
+		return fmt.Errorf("no SocksPort")
+	}
+
+	if err := writePid(opt(args, "--PidFile")); err != nil {
+		return err
+	}
+
+	for _, spec := range ports {
+		addr := strings.Fields(spec)[0]
+		if !strings.HasPrefix(addr, "unix:") {
+			addr = "127.0.0.1:" + addr
+		}
+
+		l, err := listen(addr)
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				conn.Close()
+			}
+		}()
+	}
+
+	if control := opt(args, "--ControlSocket"); control != "" {
+		cookie := filepath.Join(opt(args, "--DataDirectory"), "control_auth_cookie")
+		if err := os.WriteFile(cookie, []byte("0123456789abcdef0123456789abcdef"), 0600); err != nil {
+			return err
+		}
+
+		cl, err := net.Listen("unix", control)
+		if err != nil {
+			return err
+		}
+		defer cl.Close()
+
+		go acceptControl(cl)
+	}
+
+	torLog("notice", "Tor 0.4.8.9 running on Linux.")
+	for _, step := range []string{"5% (conn): Connecting to a relay", "50% (loading_descriptors): Loading relay descriptors", "100% (done): Done"} {
+		time.Sleep(50 * time.Millisecond)
+		torLog("notice", "Bootstrapped "+step)
+	}
+
+	waitForSignal()
+
+	return nil
+}
+
+// acceptControl answers every line sent to the control port with 250 OK.
+func acceptControl(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+
+			scanner := bufio.NewScanner(conn)
+			for scanner.Scan() {
+				fmt.Fprint(conn, "250 OK\r\n")
+			}
+		}()
+	}
+}
+
+func privoxy(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("no config file")
+	}
+
+	conf, err := os.ReadFile(args[len(args)-1])
+	if err != nil {
+		return err
+	}
+
+	var addr string
+	for _, line := range strings.Split(string(conf), "\n") {
+		if f := strings.Fields(line); len(f) == 2 && f[0] == "listen-address" {
+			addr = f[1]
+		}
+	}
+
+	if addr == "" {
+		return fmt.Errorf("no listen-address")
+	}
+
+	if err = writePid(opt(args, "--pidfile")); err != nil {
+		return err
+	}
+
+	l, err := listen(addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	go serve(l, "fake privoxy")
+
+	fmt.Printf("%s 7f0000000000 Info: Listening on port %s\n", time.Now().Format("2006-01-02 15:04:05.000"), addr)
+
+	waitForSignal()
+
+	return nil
+}
+
+func haproxy(args []string) error {
+	conf := opt(args, "-f")
+	raw, err := os.ReadFile(conf)
+	if err != nil {
+		return err
+	}
+
+	// checking the config takes HAProxy a moment. A server on port 1 stands in for a config HAProxy would reject, so that
+	// tests can make a reload fail.
+	time.Sleep(50 * time.Millisecond)
+	if strings.Contains(string(raw), " 127.0.0.1:1 ") {
+		return fmt.Errorf("[ALERT] (%d) : config : backend 'privoxies' has an invalid server", os.Getpid())
+	}
+
+	// -c only checks the config
+	for _, a := range args {
+		if a == "-c" {
+			fmt.Println("Configuration file is valid")
+			return nil
+		}
+	}
+
+	for _, a := range args {
+		if a == "-W" {
+			return haproxyMaster(args)
+		}
+	}
+
+	var (
+		binds   []string
+		socket  string
+		servers []string
+	)
+	for _, line := range strings.Split(string(raw), "\n") {
+		f := strings.Fields(line)
+		switch {
+		case len(f) >= 2 && f[0] == "bind":
+			binds = append(binds, f[1])
+		case len(f) >= 3 && f[0] == "stats" && f[1] == "socket":
+			socket = f[2]
+		case len(f) >= 2 && f[0] == "server":
+			servers = append(servers, f[1])
+		}
+	}
+
+	// take over from the previous instance the same way HAProxy does, though without sharing the ports: it stops
+	// listening right away, and the ports are taken as soon as they're free
+	if sf := opt(args, "-sf"); sf != "" {
+		pid, _ := strconv.Atoi(sf)
+		syscall.Kill(pid, syscall.SIGUSR1)
+	}
+
+	if err = writePid(opt(args, "-p")); err != nil {
+		return err
+	}
+
+	var listeners []net.Listener
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+
+	for _, b := range binds {
+		// "*:8080" and ":8080" both mean every address
+		b = strings.TrimPrefix(b, "*")
+		if strings.HasPrefix(b, "::") {
+			continue
+		}
+
+		l, err := listen(b)
+		for i := 0; err != nil && i < 100; i++ {
+			time.Sleep(20 * time.Millisecond)
+			l, err = listen(b)
+		}
+		if err != nil {
+			return err
+		}
+		listeners = append(listeners, l)
+
+		go serve(l, "fake haproxy")
+	}
+
+	if socket != "" {
+		os.Remove(socket)
+		l, err := net.Listen("unix", socket)
+		if err != nil {
+			return err
+		}
+		listeners = append(listeners, l)
+
+		go acceptStats(l, servers)
+	}
+
+	fmt.Printf("[NOTICE] (%d) : loaded %d servers\n", os.Getpid(), len(servers))
+
+	if waitForSignal() == syscall.SIGUSR1 {
+		// stop listening, but finish up before exiting
+		for _, l := range listeners {
+			l.Close()
+		}
+		time.Sleep(SOFT_STOP_LINGER)
+	}
+
+	return nil
+}
+
+// acceptStats answers "show stat" on HAProxy's runtime API with a row for each server, and anything else with an empty
+// response, which is how HAProxy acknowledges commands such as "set weight".
+func acceptStats(l net.Listener, servers []string) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		cmd, _ := bufio.NewReader(conn).ReadString('\n')
+		if strings.TrimSpace(cmd) == "show stat" {
+			fmt.Fprintln(conn, "# pxname,svname,status,weight,scur,stot,bin,bout")
+			for _, s := range servers {
+				fmt.Fprintf(conn, "privoxies,%s,UP,100,0,0,0,0\n", s)
+			}
+			fmt.Fprintln(conn, "privoxies,BACKEND,UP,0,0,0,0,0")
+		}
+
+		conn.Close()
+	}
+}
+
+// haproxyMaster runs workers the way HAProxy's master-worker mode does, starting a new one on SIGUSR2 and listing the
+// current one, along with any old ones still finishing up, on the master socket.
+func haproxyMaster(args []string) error {
+	var workerArgs []string
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-W":
+		case "-S", "-p":
+			i++
+		default:
+			workerArgs = append(workerArgs, args[i])
+		}
+	}
+
+	if err := writePid(opt(args, "-p")); err != nil {
+		return err
+	}
+
+	// running holds every worker that hasn't exited, including worker, the current one
+	var (
+		mu      sync.Mutex
+		worker  *exec.Cmd
+		running = make(map[int]*exec.Cmd)
+	)
+	start := func(prev int) *exec.Cmd {
+		a := append([]string{}, workerArgs...)
+		if prev > 0 {
+			a = append(a, "-sf", strconv.Itoa(prev))
+		}
+		c := exec.Command(os.Args[0], a...)
+		c.Stdout, c.Stderr = os.Stdout, os.Stderr
+		if c.Start() == nil {
+			running[c.Process.Pid] = c
+			go func() {
+				c.Wait()
+				mu.Lock()
+				delete(running, c.Process.Pid)
+				mu.Unlock()
+			}()
+		}
+		return c
+	}
+	mu.Lock()
+	worker = start(0)
+	mu.Unlock()
+
+	os.Remove(opt(args, "-S"))
+	l, err := net.Listen("unix", opt(args, "-S"))
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			bufio.NewReader(conn).ReadString('\n')
+			mu.Lock()
+			fmt.Fprintf(conn, "#<PID>          <type>          <reloads>\n%d master 0\n# workers\n%d worker 0\n# old workers\n", os.Getpid(), worker.Process.Pid)
+			for pid := range running {
+				if pid != worker.Process.Pid {
+					fmt.Fprintf(conn, "%d worker 1\n", pid)
+				}
+			}
+			mu.Unlock()
+			conn.Close()
+		}
+	}()
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR1, syscall.SIGUSR2)
+	for sig := range c {
+		if sig != syscall.SIGUSR2 {
+			mu.Lock()
+			for _, w := range running {
+				w.Process.Signal(sig)
+			}
+			mu.Unlock()
+			return nil
+		}
+		fmt.Printf("[NOTICE] (%d) : reloading\n", os.Getpid())
+		mu.Lock()
+		worker = start(worker.Process.Pid)
+		mu.Unlock()
+	}
+
+	return nil
+}
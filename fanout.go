@@ -0,0 +1,213 @@
+package torotator
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/uber-go/zap"
+)
+
+// SharedPrivoxy is the single Privoxy in front of a pool when -fanout-interval is set. Rather than running one Privoxy
+// per Tor instance, its forward-socks5t target is rewritten every interval to cycle through the pool's Tor instances.
+// Privoxy notices the changed config on its next request, so it never needs to be restarted.
+type SharedPrivoxy struct {
+	ha  *HAProxy
+	log zap.Logger
+
+	mu      sync.Mutex
+	privoxy *Privoxy
+	tors    []*Tor
+	current *Tor
+}
+
+// NewSharedPrivoxy prepares the shared Privoxy for the pool served by ha. Privoxy itself isn't started until the first
+// Tor instance is ready, so that requests never go out without Tor.
+func NewSharedPrivoxy(ha *HAProxy) *SharedPrivoxy {
+	return &SharedPrivoxy{
+		ha:  ha,
+		log: log.With(zap.String("service", "fanout"), zap.Int("pool", ha.Port)),
+	}
+}
+
+// Add makes tor available as a forwarding target, starting Privoxy with it if nothing else is.
+func (s *SharedPrivoxy) Add(ctx context.Context, tor *Tor) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tors = append(s.tors, tor)
+
+	switch {
+	case s.privoxy == nil:
+		s.start(ctx, tor)
+	case s.current == nil:
+		s.forward(tor)
+	}
+}
+
+// Remove stops forwarding to tor, moving on to another Tor instance right away if tor was the current target.
+func (s *SharedPrivoxy) Remove(tor *Tor) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, t := range s.tors {
+		if t == tor {
+			s.tors = append(s.tors[:i], s.tors[i+1:]...)
+			break
+		}
+	}
+
+	if s.current != tor {
+		return
+	}
+
+	s.current = nil
+	if len(s.tors) > 0 && s.privoxy != nil {
+		s.forward(s.tors[0])
+	}
+}
+
+// Run cycles the forwarding target every interval, restarting Privoxy should it exit, until ctx is canceled.
+func (s *SharedPrivoxy) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		var exited <-chan struct{}
+		s.mu.Lock()
+		if s.privoxy != nil {
+			exited = s.privoxy.Done()
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			s.mu.Lock()
+			s.stop(ctx)
+			s.mu.Unlock()
+			return
+
+		case <-exited:
+			s.mu.Lock()
+			s.log.Warn("privoxy exited; restarting")
+			s.stop(ctx)
+			if len(s.tors) > 0 {
+				s.start(ctx, s.tors[0])
+			}
+			s.mu.Unlock()
+
+		case <-t.C:
+			s.rotate()
+		}
+	}
+}
+
+// rotate moves on to the Tor instance after the current one.
+func (s *SharedPrivoxy) rotate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.privoxy == nil || len(s.tors) < 2 {
+		return
+	}
+
+	next := 0
+	for i, t := range s.tors {
+		if t == s.current {
+			next = (i + 1) % len(s.tors)
+			break
+		}
+	}
+
+	s.forward(s.tors[next])
+}
+
+// start starts Privoxy forwarding to tor and adds it to HAProxy. The caller must hold mu.
+func (s *SharedPrivoxy) start(ctx context.Context, tor *Tor) {
+	p, err := NewPrivoxy(ctx, NextProxyID(), tor)
+	if err != nil {
+		return
+	}
+
+	mapPorts(0, p.port)
+	go p.Wait()
+
+	s.privoxy, s.current = p, tor
+	s.log = s.log.With(zap.Int("privoxy", p.port))
+	s.log.Info("shared privoxy started", zap.Int("tor", tor.port))
+
+	s.ha.AddBackend(ctx, p.port, &Backend{Proxy: p.proxy})
+}
+
+// stop removes Privoxy from HAProxy and shuts it down. The caller must hold mu.
+func (s *SharedPrivoxy) stop(ctx context.Context) {
+	if s.privoxy == nil {
+		return
+	}
+
+	s.ha.RemoveBackend(ctx, s.privoxy.port)
+	s.privoxy.Close()
+	unmapPorts(0, s.privoxy.port)
+
+	s.privoxy, s.current = nil, nil
+}
+
+// forward points Privoxy at tor. The caller must hold mu.
+func (s *SharedPrivoxy) forward(tor *Tor) {
+	if err := s.privoxy.Attach(tor); err != nil {
+		s.log.Error("failed to rewrite config", zap.Error(err))
+		return
+	}
+
+	s.current = tor
+	s.log.Debug("forwarding to tor", zap.Int("tor", tor.port), zap.Int("available", len(s.tors)))
+}
+
+// RunFanout obtains a Tor node and offers it to the pool's shared Privoxy for as long as it lasts, like RunProxy does for
+// a Tor+Privoxy pair.
+func RunFanout(ctx context.Context, shared *SharedPrivoxy, spares *Spares) {
+	tor, err := spares.Get(ctx)
+	exhaustion.Check(err)
+	if err != nil {
+		// a failed Tor has already cleaned up after itself
+		return
+	}
+
+	mapPorts(tor.TCPPort(), 0)
+
+	_log := tor.log.With(zap.Int("pool", shared.ha.Port))
+	_log.Info("tor joined fan-out")
+	started := time.Now()
+
+	shared.Add(ctx, tor)
+
+	recycle := recycler.Register(tor.port)
+	defer recycler.Unregister(recycle)
+
+	var expire <-chan time.Time
+	if ProxiesExpire() {
+		expire = time.After(ProxyLifetime())
+	}
+
+	var reason string
+	select {
+	case <-ctx.Done():
+		reason = RECYCLE_SHUTDOWN
+	case <-tor.Done():
+		reason = RECYCLE_TOR_EXITED
+	case <-tor.Stuck(ctx):
+		reason = RECYCLE_TOR_STUCK
+	case <-expire:
+		reason = RECYCLE_EXPIRED
+	case <-recycle:
+		reason = RECYCLE_REQUESTED
+	case <-MonitorExit(ctx, _log, tor):
+		reason = RECYCLE_UNHEALTHY
+	}
+
+	shared.Remove(tor)
+	tor.Close()
+	unmapPorts(tor.TCPPort(), 0)
+
+	_log.Info("tor left fan-out", zap.String("reason", reason), zap.Duration("age", time.Since(started)))
+}
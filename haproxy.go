@@ -0,0 +1,1577 @@
+package torotator
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
+	"time"
+
+	"github.com/uber-go/zap"
+)
+
+const HAPROXY_TPL = `
+global
+  maxconn {{.MaxConn}}{{ if .MaxOpenFiles }}
+  ulimit-n {{.MaxOpenFiles}}{{ end }}
+  stats socket {{.Socket}} level admin{{ if .User }}
+  user {{.User}}{{ end }}{{ if .Group }}
+  group {{.Group}}{{ end }}
+
+defaults
+  mode http
+  maxconn {{.DefaultMaxConn}}
+{{ if eq .LogMode "http" }}  option  httplog
+{{ else if eq .LogMode "tcp" }}  option  tcplog
+{{ else }}  no log
+{{ end }}  option  dontlognull
+  retries {{.Retries}}{{ if .Redispatch }}
+  option  redispatch{{ end }}
+  timeout connect {{ ms .TimeoutConnect }}
+  timeout client  {{ ms .TimeoutClient }}
+  timeout server  {{ ms .TimeoutServer }}
+
+{{ if .EnableStats }}
+listen stats
+  bind            :{{.StatsPort}}
+  mode            http
+  maxconn 10
+  timeout client  100s
+  timeout server  100s
+  timeout connect 100s
+  timeout queue   100s
+  stats enable
+  stats hide-version
+  stats refresh 30s
+  stats show-node
+  stats uri /haproxy?stats
+{{ end }}
+
+frontend rotating_proxies
+  bind {{.BindAddress}}:{{.Port}}{{ if .Certificate }} ssl crt {{.Certificate}}{{ end }}{{ if and .IPv6 (eq .BindAddress "*") }}
+  bind :::{{.Port}} v6only{{ if .Certificate }} ssl crt {{.Certificate}}{{ end }}{{ end }}
+  default_backend privoxies
+  option http_proxy{{ if .HealthPath }}
+  # answered by HAProxy itself so that checking torotator's health doesn't use a circuit
+  acl health_check path {{.HealthPath}}
+  http-request return status 200 content-type text/plain string "OK" if health_check{{ end }}{{ if .Allow }}
+  acl allowed src{{ range .Allow }} {{ . }}{{ end }}
+  http-request deny if !allowed{{ end }}
+
+backend privoxies
+  balance roundrobin
+  timeout http-keep-alive {{ ms .KeepAliveTimeout }}
+{{ if gt .StickyTTL 0 }}
+  # keep each client on the same exit for a while
+  stick-table type ip size 100k expire {{ ms .StickyTTL }}
+  stick on src
+{{ end }}{{ if eq .ForwardedFor "append" }}
+  option forwardfor{{ else if eq .ForwardedFor "strip" }}
+  http-request del-header X-Forwarded-For
+  http-request del-header Forwarded
+  http-request del-header Via{{ end }}
+{{ if eq .KeepAlive "server-close" }}  option http-server-close
+{{ else if eq .KeepAlive "reuse" }}  option http-keep-alive
+  # idle connections may be handed to other clients, which then share their circuit
+  http-reuse safe
+{{ else }}  option http-keep-alive
+  http-reuse never
+{{ end }}  option http_proxy
+  {{ range $port, $be := .Backends }}
+  server privoxy-{{ $port }} 127.0.0.1:{{ $port }} weight {{ if $be.Draining }}0{{ else }}{{ $be.Weight }}{{ end }} maxconn {{ $.ServerMaxConn }} check{{ if $be.Direct }}  # direct, bypasses Tor{{ end }}{{ end }}
+{{ if .Extra }}
+# from -haproxy-extra
+{{ .Extra }}
+{{ end }}`
+
+const (
+	// FULL_WEIGHT is the HAProxy weight of a backend that has finished warming up.
+	FULL_WEIGHT = 100
+
+	// WARMUP_WEIGHT is the HAProxy weight given to a freshly added backend, whose circuit is likely still slow.
+	WARMUP_WEIGHT = 10
+)
+
+// Backend describes a single Tor+Privoxy pair as seen by HAProxy.
+type Backend struct {
+	Weight int
+	Added  time.Time
+
+	// Proxy identifies the proxy behind the backend across the logs of every service involved
+	Proxy int64
+
+	// Draining is set once the backend has been told to finish its current connections without taking new ones
+	Draining bool
+
+	// Retiring is set when the backend is to go away without a replacement because the pool shrank
+	Retiring bool
+
+	// Direct is set when the backend's Privoxy connects straight to the internet instead of through Tor
+	Direct bool
+
+	// Latency holds the times of the backend's recent health checks
+	Latency Latency
+
+	// Circuit is the newest circuit of the backend's Tor, when -circuit-info is set
+	Circuit *Circuit
+
+	// BytesIn and BytesOut total the traffic through the backend over its lifetime, built up from HAProxy's counters,
+	// which were last seen at seenIn and seenOut
+	BytesIn  int64
+	BytesOut int64
+	seenIn   int64
+	seenOut  int64
+}
+
+// LIVE_POLL is how often HAProxy is asked whether a new backend is up yet.
+const LIVE_POLL = 250 * time.Millisecond
+
+// MASTER_POLL is how often the HAProxy master is asked whether a reload has brought up a new worker.
+const MASTER_POLL = 100 * time.Millisecond
+
+// reloadTimerSlack is how long past the reload window a queued reload waits for its timer before reloading anyway.
+var reloadTimerSlack = 10 * time.Second
+
+// HAPROXY_CHECK_TIMEOUT is how long HAProxy may take to check a config.
+const HAPROXY_CHECK_TIMEOUT = 10 * time.Second
+
+// haproxyExtra holds the contents of the -haproxy-extra file, which is appended to every generated config.
+var haproxyExtra string
+
+// HAPROXY_SPARE_FILES is how many files HAProxy may need open beyond two for each connection, for its listeners, stats
+// socket, pid file and the like.
+const HAPROXY_SPARE_FILES = 64
+
+// HAProxy helps manage an instance of HAProxy.
+type HAProxy struct {
+	log  zap.Logger
+	pool *Pool
+
+	// cmd is the running instance of HAProxy. A reload replaces it while holding mu, so it is read through current once
+	// HAProxy has started.
+	cmd *Cmd
+
+	dir      string
+	conf     string
+	good     string
+	confOut  string
+	template *template.Template
+	mu       sync.Mutex
+	delay    *time.Timer
+	window   int64
+	reloadQ  chan bool
+
+	// procs holds a slot for each HAProxy process that is running, when -haproxy-max-procs caps them
+	procs chan struct{}
+
+	// slots holds a slot for each proxy in the pool. retiring counts the proxies picked to go away after the pool shrank
+	// that still hold theirs, and shrinking is set while they are being picked.
+	slots     *Slots
+	retiring  int
+	shrinking bool
+
+	lastReload time.Time
+	recycled   []RecycledStatus
+
+	// direct counts the backends currently bypassing Tor
+	direct int
+
+	// requested counts every call to Reload, so a reload can tell whether anything changed while it was running, and
+	// coalesced counts those that were folded into a reload that was already queued
+	requested int64
+	coalesced int64
+
+	// confMu keeps concurrent config writes from interleaving on disk
+	confMu sync.Mutex
+
+	// filled is set once the pool first reaches its full size, after which every change in membership is summarized
+	filled bool
+
+	// takeover is the pid file of the HAProxy instance this one replaces when torotator was started by an upgrade. It
+	// is cleared once HAProxy has started and told that instance to stop.
+	takeover string
+
+	Allow          []string
+	BindAddress    string
+	Certificate    string
+	ForwardedFor   string
+	HealthPath     string
+	LogMode        string
+	User           string
+	Group          string
+	EnableStats    bool
+	IPv6           bool
+	MaxConn        int
+	MaxOpenFiles   int
+	DefaultMaxConn int
+	ServerMaxConn  int
+	PidFile        string
+	Port           int
+	Socket         string
+	MasterSocket   string
+	StatsPort      int
+	Backends       map[int]*Backend
+	Extra          string
+
+	TimeoutConnect time.Duration
+	TimeoutClient  time.Duration
+	TimeoutServer  time.Duration
+	StickyTTL      time.Duration
+
+	KeepAlive        string
+	KeepAliveTimeout time.Duration
+
+	Retries    int
+	Redispatch bool
+}
+
+func NewHAProxy(ctx context.Context, pool *Pool) (h *HAProxy, err error) {
+	if h, err = ConfigureHAProxy(pool); err != nil {
+		return nil, err
+	}
+
+	// the ports are still held by the instance being replaced, which HAProxy binds alongside
+	h.takeover = takeovers[pool.Port]
+
+	if h.takeover == "" {
+		// an instance that crashed can leave files behind that would pass for a running one
+		h.RemoveStale()
+
+		// make sure the frontend can actually bind before HAProxy tries to
+		if err = h.CheckFrontend(); err != nil {
+			return nil, err
+		}
+
+		// a stats port that can't be bound would take the frontend down with it
+		if err = h.CheckStats(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = h.WriteCertificate(); err != nil {
+		h.log.Error("failed to write certificate", zap.Error(err))
+		return nil, err
+	}
+
+	if err = h.WriteConfig(ctx, false); err != nil {
+		h.log.Error("failed to write config", zap.Error(err))
+		return nil, err
+	}
+
+	if err = h.CheckConfig(ctx); err != nil {
+		h.log.Error("invalid config", zap.Error(err))
+		return nil, err
+	}
+
+	// HAProxy isn't started until the pool can take over, see Reload
+	if h.takeover != "" {
+		h.log.Info("waiting for backends before taking over", zap.String("from", h.takeover))
+		return h, nil
+	}
+
+	if err = h.acquireProc(ctx); err != nil {
+		return nil, err
+	}
+
+	h.cmd, err = StartCommand(ctx, h.log, h.Listening, cfg.HAProxyBin, h.Args()...)
+	h.trackProc(h.cmd)
+	if err != nil {
+		h.log.Error("failed to setup command", zap.Error(err))
+		return nil, err
+	}
+
+	h.cmd.transformLog = h.HAProxyLogger
+	h.SaveGoodConfig()
+
+	return h, nil
+}
+
+// ConfigureHAProxy prepares the configuration for an instance of HAProxy without writing or starting anything.
+func ConfigureHAProxy(pool *Pool) (h *HAProxy, err error) {
+	h = &HAProxy{
+		log:     log.With(zap.String("service", "haproxy"), zap.Int("port", pool.Port)),
+		pool:    pool,
+		dir:     path.Join(runDir, fmt.Sprintf("haproxy-%d", pool.Port)),
+		delay:   time.NewTimer(cfg.ReloadDelay),
+		window:  int64(cfg.ReloadDelay),
+		reloadQ: make(chan bool, 1),
+		slots:   NewSlots(pool.Count),
+
+		BindAddress:  cfg.BindAddress,
+		ForwardedFor: cfg.ForwardedFor,
+		HealthPath:   cfg.HealthPath,
+		LogMode:      cfg.HAProxyLog,
+		User:         cfg.HAProxyUser,
+		Group:        cfg.HAProxyGroup,
+		EnableStats:  pool.StatsPort > 0,
+		IPv6:         cfg.IPv6,
+		Port:         pool.Port,
+		StatsPort:    pool.StatsPort,
+		MaxOpenFiles: cfg.MaxOpenFiles,
+		Backends:     make(map[int]*Backend),
+		Extra:        haproxyExtra,
+	}
+
+	if cfg.HAProxyMaxProcs > 0 {
+		h.procs = make(chan struct{}, cfg.HAProxyMaxProcs)
+	}
+
+	h.Tune()
+
+	t := template.New("haproxy").Funcs(template.FuncMap{
+		// HAProxy understands explicit units, so durations are rendered in milliseconds
+		"ms": func(d time.Duration) string {
+			return fmt.Sprintf("%dms", d/time.Millisecond)
+		},
+	})
+	if h.template, err = t.Parse(HAPROXY_TPL); err != nil {
+		h.log.Error("unable to parse template", zap.Error(err))
+		return nil, err
+	}
+
+	h.conf = path.Join(h.dir, "haproxy.cfg")
+	h.PidFile = path.Join(h.dir, "haproxy.pid")
+	h.Socket = path.Join(h.dir, "haproxy.sock")
+	h.MasterSocket = path.Join(h.dir, "master.sock")
+	h.good = h.conf + ".good"
+	h.confOut = ConfigOut(h.Port)
+
+	if cfg.TLSCert != "" {
+		h.Certificate = path.Join(h.dir, "frontend.pem")
+	}
+
+	return h, nil
+}
+
+// Tune copies the settings that may change while running, such as timeouts and connection limits, from the Config last
+// applied by Manager.Reload. The caller is responsible for rewriting the config afterwards.
+func (h *HAProxy) Tune() {
+	c, allow := tunedConfig()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.Allow = allow
+	h.MaxConn = c.MaxConn
+	h.DefaultMaxConn = c.DefaultMaxConn
+	h.ServerMaxConn = c.ServerMaxConn
+
+	h.TimeoutConnect = c.TimeoutConnect
+	h.TimeoutClient = c.TimeoutClient
+	h.TimeoutServer = c.TimeoutServer
+	h.StickyTTL = c.StickyTTL
+
+	h.KeepAlive = c.BackendKeepAlive
+	h.KeepAliveTimeout = c.BackendKeepAliveTime
+
+	h.Retries = c.Retries
+	h.Redispatch = c.Redispatch
+
+	// proxy sections can't usefully accept more than the global limit
+	if h.DefaultMaxConn <= 0 {
+		h.DefaultMaxConn = h.MaxConn
+	}
+
+	// unless told otherwise, each Tor+Privoxy pair gets an even share of the global limit
+	if h.ServerMaxConn <= 0 {
+		h.ServerMaxConn = h.MaxConn / h.Size()
+		if h.ServerMaxConn < 1 {
+			h.ServerMaxConn = 1
+		}
+	}
+}
+
+var (
+	// tuned is the Config that the settings which may change while running are read from, and allowedNetworks holds the
+	// source networks parsed from its Allow that are permitted to use the frontend. Everyone is allowed when it is empty.
+	// A reload replaces both at once, holding tunedMu.
+	tunedMu         sync.RWMutex
+	tuned           = cfg
+	allowedNetworks []string
+)
+
+// tunedConfig returns the Config holding the settings that may change while running, along with the networks allowed
+// to use the frontend. Neither may be changed.
+func tunedConfig() (*Config, []string) {
+	tunedMu.RLock()
+	defer tunedMu.RUnlock()
+
+	return tuned, allowedNetworks
+}
+
+// setTuned replaces the Config the settings that may change while running are read from, and the networks allowed to
+// use the frontend.
+func setTuned(c *Config, allow []string) {
+	tunedMu.Lock()
+	tuned, allowedNetworks = c, allow
+	tunedMu.Unlock()
+}
+
+// ParseNetworks parses a comma-separated list of CIDR ranges or single IP addresses, such as "10.0.0.0/8,192.168.1.5".
+func ParseNetworks(list string) (out []string, err error) {
+	for _, field := range strings.Split(list, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+
+		if _, n, err := net.ParseCIDR(field); err == nil {
+			out = append(out, n.String())
+			continue
+		}
+
+		if net.ParseIP(field) == nil {
+			return nil, fmt.Errorf("invalid network %q", field)
+		}
+
+		out = append(out, field)
+	}
+
+	return out, nil
+}
+
+// CheckFrontend verifies that the frontend port is free on every address HAProxy will bind it to.
+func (h *HAProxy) CheckFrontend() error {
+	if h.BindAddress != "*" {
+		network := "tcp4"
+		if net.ParseIP(h.BindAddress).To4() == nil {
+			network = "tcp6"
+		}
+
+		if !portAvailable(network, h.BindAddress, h.Port) {
+			return fmt.Errorf("frontend port %d is already in use on %s", h.Port, h.BindAddress)
+		}
+
+		return nil
+	}
+
+	if !portAvailable("tcp4", "", h.Port) {
+		return fmt.Errorf("frontend port %d is already in use", h.Port)
+	}
+
+	if h.IPv6 && !portAvailable("tcp6", "::", h.Port) {
+		return fmt.Errorf("frontend port %d is already in use on IPv6", h.Port)
+	}
+
+	return nil
+}
+
+// CheckStats verifies that the stats port is free, dealing with a conflict as configured: by failing, moving to the next
+// free port, or disabling stats.
+func (h *HAProxy) CheckStats() error {
+	if !h.EnableStats || portAvailable("tcp4", "", h.StatsPort) {
+		return nil
+	}
+
+	switch cfg.StatsConflict {
+	case "next":
+		for p := h.StatsPort + 1; p < 65535; p++ {
+			if pools.Uses(p) || !portAvailable("tcp4", "", p) {
+				continue
+			}
+
+			h.log.Warn("stats port is already in use; using the next free port",
+				zap.Int("stats", h.StatsPort),
+				zap.Int("next", p))
+			h.StatsPort = p
+			h.pool.StatsPort = p
+			return nil
+		}
+
+		return fmt.Errorf("no free port for stats after %d", h.StatsPort)
+
+	case "disable":
+		h.log.Warn("stats port is already in use; disabling stats", zap.Int("stats", h.StatsPort))
+		h.EnableStats = false
+		h.StatsPort = 0
+		h.pool.StatsPort = 0
+		return nil
+	}
+
+	return fmt.Errorf("stats port %d is already in use", h.StatsPort)
+}
+
+// Listening reports whether HAProxy's runtime API is accepting connections, which happens once it has loaded its
+// configuration.
+func (h *HAProxy) Listening() bool {
+	return socketListening(h.Socket)
+}
+
+// RemoveStale removes the pid file and stats socket left behind by an instance of HAProxy that is no longer running,
+// such as one that crashed. Files belonging to an instance that is still running are left alone.
+func (h *HAProxy) RemoveStale() {
+	if pid, err := readPid(h.PidFile); err == nil && !processExited(pid) {
+		h.log.Warn("haproxy from an earlier run is still running", zap.Int("pid", pid), zap.String("pidfile", h.PidFile))
+		return
+	} else if !os.IsNotExist(err) {
+		if rerr := os.Remove(h.PidFile); rerr != nil {
+			h.log.Error("failed to remove stale pid file", zap.String("path", h.PidFile), zap.Error(rerr))
+		} else {
+			h.log.Warn("removed stale pid file", zap.String("path", h.PidFile), zap.Int("pid", pid))
+		}
+	}
+
+	if _, err := os.Stat(h.Socket); err != nil || socketListening(h.Socket) {
+		return
+	}
+
+	if err := os.Remove(h.Socket); err != nil {
+		h.log.Error("failed to remove stale stats socket", zap.String("path", h.Socket), zap.Error(err))
+	} else {
+		h.log.Warn("removed stale stats socket", zap.String("path", h.Socket))
+	}
+}
+
+// MakeDirs attempts to create the directory where HAProxy-related files will reside, owned by the user and group HAProxy
+// runs as, if any.
+func (h *HAProxy) MakeDirs() (err error) {
+	if err = os.MkdirAll(h.dir, 0755); err != nil {
+		return
+	}
+
+	if haproxyUID >= 0 || haproxyGID >= 0 {
+		return os.Chown(h.dir, haproxyUID, haproxyGID)
+	}
+
+	return nil
+}
+
+var (
+	// haproxyUID and haproxyGID are the ids HAProxy's user and group resolve to, or -1 to leave ownership alone
+	haproxyUID = -1
+	haproxyGID = -1
+)
+
+// LookupHAProxyUser resolves -haproxy-user and -haproxy-group, which only root may switch to.
+func LookupHAProxyUser() error {
+	if cfg.HAProxyUser == "" && cfg.HAProxyGroup == "" {
+		return nil
+	}
+
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("haproxy-user and haproxy-group require running as root")
+	}
+
+	if cfg.HAProxyUser != "" {
+		u, err := user.Lookup(cfg.HAProxyUser)
+		if err != nil {
+			return err
+		}
+		haproxyUID, _ = strconv.Atoi(u.Uid)
+	}
+
+	if cfg.HAProxyGroup != "" {
+		g, err := user.LookupGroup(cfg.HAProxyGroup)
+		if err != nil {
+			return err
+		}
+		haproxyGID, _ = strconv.Atoi(g.Gid)
+	}
+
+	return nil
+}
+
+// ReadHAProxyExtra loads the file named by -haproxy-extra, if any.
+func ReadHAProxyExtra() error {
+	if cfg.HAProxyExtraFile == "" {
+		return nil
+	}
+
+	raw, err := os.ReadFile(cfg.HAProxyExtraFile)
+	if err != nil {
+		return err
+	}
+
+	haproxyExtra = strings.TrimRight(string(raw), "\n")
+	return nil
+}
+
+// CheckConfig has HAProxy check the config on disk, so that a broken -haproxy-extra snippet is caught before any
+// instance loads it. The generated config is trusted as it is when there's no snippet.
+func (h *HAProxy) CheckConfig(ctx context.Context) error {
+	if h.Extra == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, HAPROXY_CHECK_TIMEOUT)
+	defer cancel()
+
+	// keep the config from being rewritten while HAProxy reads it
+	h.confMu.Lock()
+	out, err := exec.CommandContext(ctx, cfg.HAProxyBin, "-c", "-f", h.conf).CombinedOutput()
+	h.confMu.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("haproxy rejected %s: %v: %s", h.conf, err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// WriteCertificate writes the frontend's certificate and private key to a single PEM file, which is how HAProxy expects
+// to find them. It does nothing unless TLS is enabled.
+func (h *HAProxy) WriteCertificate() (err error) {
+	if h.Certificate == "" {
+		return nil
+	}
+
+	if err = h.MakeDirs(); err != nil {
+		return
+	}
+
+	var pem []byte
+	if pem, err = os.ReadFile(cfg.TLSCert); err != nil {
+		return
+	}
+
+	if cfg.TLSKey != "" {
+		var key []byte
+		if key, err = os.ReadFile(cfg.TLSKey); err != nil {
+			return
+		}
+
+		if len(pem) > 0 && pem[len(pem)-1] != '\n' {
+			pem = append(pem, '\n')
+		}
+		pem = append(pem, key...)
+	}
+
+	return os.WriteFile(h.Certificate, pem, 0600)
+}
+
+// HAProxyLogger processes each message received from HAProxy's stdout and stderr. It attempt to categorize each
+// message with the correct logging level based on the content of the log line.
+func (h *HAProxy) HAProxyLogger(line string) (level, msg string, fields []zap.Field) {
+	line = line[1:]
+
+	lvlPos := strings.Index(line, "]")
+	level = strings.ToLower(line[:lvlPos])
+	switch level {
+	case "alert":
+		level = "error"
+	case "warning":
+		level = "warn"
+	default:
+		h.log.Debug("noticed unmapped log level", zap.String("name", level))
+	}
+
+	line = line[lvlPos:]
+	msgPos := strings.Index(line, ":")
+	msg = line[msgPos+2:]
+
+	return
+}
+
+// WriteConfig persists the current HAProxy configuration to disk. This may also signal the current instance of HAProxy
+// to reload the configuration after it's written to disk.
+func (h *HAProxy) WriteConfig(ctx context.Context, reload bool) (err error) {
+	if err = h.MakeDirs(); err != nil {
+		return
+	}
+
+	if err = h.writeConf(); err != nil {
+		return
+	}
+
+	if reload {
+		if err = h.Reload(ctx); err != nil {
+			h.log.Error("failed to gracefully reload", zap.Error(err))
+			return
+		}
+	}
+
+	return nil
+}
+
+// writeConf renders the current configuration to disk, along with a copy for -haproxy-config-out. Writes are serialized
+// so that the file always holds a complete config, rendered no earlier than the one before it.
+func (h *HAProxy) writeConf() (err error) {
+	var buf bytes.Buffer
+
+	h.confMu.Lock()
+	defer h.confMu.Unlock()
+
+	if err = h.Render(&buf); err != nil {
+		h.log.Error("unable to render template", zap.Error(err))
+		return
+	}
+
+	if err = os.WriteFile(h.conf, buf.Bytes(), 0644); err != nil {
+		return
+	}
+
+	if h.confOut == "" {
+		return nil
+	}
+
+	// the copy is replaced in one step so that nothing watching it sees half a config
+	tmp := h.confOut + ".tmp"
+	if err = os.WriteFile(tmp, buf.Bytes(), 0644); err == nil {
+		err = os.Rename(tmp, h.confOut)
+	}
+
+	// HAProxy doesn't depend on the copy
+	if err != nil {
+		h.log.Warn("failed to write config copy", zap.String("path", h.confOut), zap.Error(err))
+	}
+
+	return nil
+}
+
+// ConfigOut returns where a copy of the config for the pool on port is written, or "" when -haproxy-config-out isn't
+// set. With more than one pool, the port is added before the extension to keep each pool's copy apart.
+func ConfigOut(port int) string {
+	if cfg.HAProxyConfigOut == "" || len(pools) < 2 {
+		return cfg.HAProxyConfigOut
+	}
+
+	ext := path.Ext(cfg.HAProxyConfigOut)
+	return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(cfg.HAProxyConfigOut, ext), port, ext)
+}
+
+// SaveGoodConfig keeps a copy of the config the running instance successfully loaded, so it can be restored if a later
+// config prevents HAProxy from starting.
+func (h *HAProxy) SaveGoodConfig() {
+	h.confMu.Lock()
+	defer h.confMu.Unlock()
+
+	if err := copyFile(h.conf, h.good); err != nil {
+		h.log.Warn("failed to back up config", zap.Error(err))
+	}
+}
+
+// restoreGoodConfig puts back the config the running instance loaded after a newer one failed to load. Whatever was
+// written in the meantime is rendered again by the reload that follows any change made during this one.
+func (h *HAProxy) restoreGoodConfig() {
+	h.confMu.Lock()
+	defer h.confMu.Unlock()
+
+	if err := copyFile(h.good, h.conf); err != nil {
+		h.log.Error("failed to restore last good config", zap.Error(err))
+	}
+}
+
+// copyFile replaces the contents of dst with those of src.
+func copyFile(src, dst string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(dst, data, 0644)
+}
+
+// Render writes the current HAProxy configuration to w.
+func (h *HAProxy) Render(w io.Writer) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.template.Execute(w, h)
+}
+
+// Reload instructs the current instance of HAProxy to finish serving requests, after which a new instance will replace
+// it using the newest configuration. This function attempts to throttle requests to reload HAProxy, as many
+// Tor+Privoxy pairs may expire at roughly the same time.
+func (h *HAProxy) Reload(ctx context.Context) (err error) {
+	if !h.delay.Stop() {
+		select {
+		case <-h.delay.C:
+			// drain channel, jic
+		default:
+		}
+	}
+
+	atomic.AddInt64(&h.requested, 1)
+
+	// delay reload until things have been quiet for a while
+	window := h.ReloadWindow()
+	h.delay.Reset(window)
+	select {
+	case h.reloadQ <- true:
+		h.log.Debug("reload queued")
+	default:
+		// the queued reload picks up this change as long as it hasn't started HAProxy yet, which is checked below
+		h.log.Debug("reload already queued", zap.Int64("coalesced", atomic.AddInt64(&h.coalesced, 1)))
+		return
+	}
+
+	// the generation of the config this reload applies, set just before it is loaded
+	var applied int64
+
+	// if we get this far, empty queue when we leave this function. This indicates that a reload may be re-queued.
+	defer func() {
+		<-h.reloadQ
+
+		// anything coalesced after the new instance read its config would otherwise be lost until the next change. The
+		// config is rendered again since a failed reload may have put the last good one back over it.
+		if applied > 0 && atomic.LoadInt64(&h.requested) != applied && ctx.Err() == nil {
+			h.log.Debug("config changed during reload; reloading again")
+			go h.WriteConfig(ctx, true)
+		}
+	}()
+
+	// wait for the timer to expire
+	select {
+	case <-h.delay.C:
+		h.delay.Stop()
+
+	case <-ctx.Done():
+		// shutting down; there's nothing left to reload
+		return
+
+	case <-time.After(window + reloadTimerSlack):
+		// safety net in case the timer never fires. The changes queued behind this reload still need loading, so carry on
+		// as if it had.
+		h.log.Warn("reload timer never fired; reloading anyway", zap.Duration("window", window))
+	}
+
+	// the instance being replaced is left as it is while a new process takes over from it
+	if HandingOff() {
+		h.log.Debug("not reloading while handing off")
+		return
+	}
+
+	prev := h.current()
+	if prev == nil && !h.CanTakeOver() {
+		h.log.Debug("not enough backends to take over yet")
+		return
+	}
+
+	applied = atomic.LoadInt64(&h.requested)
+
+	if err = h.CheckConfig(ctx); err != nil {
+		// nothing has been started, so the current instance carries on with the last good config
+		h.log.Error("invalid config; keeping previous instance", zap.Error(err))
+		h.restoreGoodConfig()
+		return
+	}
+
+	// a master starts new workers itself, so only the first instance is ever started here
+	if cfg.HAProxyMasterWorker && prev != nil {
+		err = h.reloadMaster(ctx, prev)
+	} else {
+		err = h.replace(ctx, prev)
+	}
+
+	if err != nil {
+		// nothing took over, so the previous instance is still serving with the last good config
+		h.restoreGoodConfig()
+		return
+	}
+
+	h.SaveGoodConfig()
+
+	// the new instance is up with the latest config, so we're usable as long as it has somewhere to send traffic
+	h.mu.Lock()
+	since := time.Since(h.lastReload)
+	h.lastReload = time.Now()
+	SetReady(h, len(h.Backends) > 0)
+	h.mu.Unlock()
+
+	h.adaptReloadWindow(since)
+
+	return nil
+}
+
+// replace starts a new instance of HAProxy that tells prev, or the instance being taken over when prev is nil, to
+// finish up nicely before the new instance takes over.
+func (h *HAProxy) replace(ctx context.Context, prev *Cmd) error {
+	args := h.Args()
+	switch {
+	case prev == nil:
+		// the first instance tells the previous process's instance to stop listening and finish up
+		pid, err := readPid(h.takeover)
+		if err != nil {
+			h.log.Warn("unable to find the instance to take over from", zap.String("from", h.takeover), zap.Error(err))
+			break
+		}
+		args = append(args, "-sf", fmt.Sprintf("%d", pid))
+
+	case prev.cmd != nil:
+		args = append(args, "-sf", fmt.Sprintf("%d", prev.Pid()))
+	}
+
+	next, err := h.startReplacement(ctx, args)
+	if err != nil {
+		h.log.Error("failed to start new instance; keeping previous instance", zap.Error(err))
+		return err
+	}
+
+	next.transformLog = h.HAProxyLogger
+	go next.Wait()
+
+	h.mu.Lock()
+	h.cmd = next
+	h.mu.Unlock()
+
+	if prev == nil {
+		h.log.Info("took over from previous process", zap.String("from", h.takeover))
+		h.mu.Lock()
+		h.takeover = ""
+		h.mu.Unlock()
+	} else if err = prev.Close(); err != nil {
+		// try to not leave zombies
+		h.log.Warn("failed to clean up previous instance", zap.Error(err))
+	}
+
+	return nil
+}
+
+// reloadMaster has the HAProxy master load the current config into new workers, which tell the previous ones to finish
+// up, and waits for a new worker to show up. A master that can't load the config keeps its previous workers.
+func (h *HAProxy) reloadMaster(ctx context.Context, master *Cmd) error {
+	workers, err := h.waitForWorkers(ctx)
+	if err != nil {
+		h.log.Error("unable to list workers; not reloading", zap.Error(err))
+		return err
+	}
+
+	before := make(map[int]bool)
+	for _, pid := range workers {
+		before[pid] = true
+	}
+
+	if err = master.Signal(syscall.SIGUSR2); err != nil {
+		h.log.Error("failed to signal master", zap.Error(err))
+		return err
+	}
+
+	timeout := time.After(cfg.ReloadTimeout)
+	for {
+		select {
+		case <-ctx.Done():
+			return ErrTerminating
+		case <-master.Done():
+			h.log.Error("master exited while reloading")
+			return &ExitError{State: master.state()}
+		case <-timeout:
+			h.log.Error("no new worker in time; keeping previous workers", zap.Duration("timeout", cfg.ReloadTimeout))
+			return ErrReloadTimeout
+		case <-time.After(MASTER_POLL):
+		}
+
+		// the master can't answer while it re-executes itself
+		after, _, err := h.Workers()
+		if err != nil {
+			continue
+		}
+
+		for _, pid := range after {
+			if !before[pid] {
+				h.log.Debug("master reloaded", zap.Int("worker", pid))
+				return nil
+			}
+		}
+	}
+}
+
+// waitForWorkers returns the pids of the master's current workers once there is room for another under
+// -haproxy-max-procs, counting old workers that are still finishing up. The master itself isn't counted.
+func (h *HAProxy) waitForWorkers(ctx context.Context) ([]int, error) {
+	timeout := time.After(cfg.ReloadTimeout)
+	for {
+		current, old, err := h.Workers()
+		if err != nil || cfg.HAProxyMaxProcs == 0 || len(current)+len(old) < cfg.HAProxyMaxProcs {
+			return current, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ErrTerminating
+		case <-timeout:
+			return nil, ErrReloadTimeout
+		case <-time.After(MASTER_POLL):
+		}
+	}
+}
+
+// Workers asks the HAProxy master for the pids of its current workers, and of any old workers still finishing up.
+func (h *HAProxy) Workers() (current, old []int, err error) {
+	resp, err := socketCommand(h.MasterSocket, "show proc")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// workers are listed under "# workers" and "# old workers", alongside sections such as "# programs"
+	var section *[]int
+	for _, line := range strings.Split(resp, "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0:
+			continue
+		case strings.HasPrefix(fields[0], "#"):
+			switch strings.TrimSpace(line) {
+			case "# workers":
+				section = &current
+			case "# old workers":
+				section = &old
+			default:
+				section = nil
+			}
+		case section != nil && len(fields) > 1 && fields[1] == "worker":
+			if pid, err := strconv.Atoi(fields[0]); err == nil {
+				*section = append(*section, pid)
+			}
+		}
+	}
+
+	return current, old, nil
+}
+
+// Args returns the arguments HAProxy is started with, before telling any previous instance to finish up.
+func (h *HAProxy) Args() []string {
+	args := []string{"-f", h.conf, "-p", h.PidFile}
+	if cfg.HAProxyMasterWorker {
+		args = append(args, "-W", "-S", h.MasterSocket)
+	}
+
+	return args
+}
+
+// acquireProc waits until another HAProxy process may be started under -haproxy-max-procs, giving up when ctx is done.
+// Every successful call must be followed by trackProc.
+func (h *HAProxy) acquireProc(ctx context.Context) error {
+	if h.procs == nil {
+		return nil
+	}
+
+	select {
+	case h.procs <- struct{}{}:
+		return nil
+	default:
+	}
+
+	h.log.Debug("waiting for a previous instance to exit", zap.Int("max_procs", cap(h.procs)))
+	select {
+	case <-ctx.Done():
+		return ErrTerminating
+	case h.procs <- struct{}{}:
+		return nil
+	}
+}
+
+// trackProc gives back the slot taken by acquireProc once cmd has exited, or right away if it never started.
+func (h *HAProxy) trackProc(cmd *Cmd) {
+	if h.procs == nil {
+		return
+	}
+
+	if cmd == nil {
+		<-h.procs
+		return
+	}
+
+	go func() {
+		<-cmd.Done()
+		<-h.procs
+	}()
+}
+
+// startReplacement starts a new instance of HAProxy with args, giving up after the reload timeout so that a hung
+// startup can't hold up every later reload. A replacement that comes up after giving up on it is shut down again and
+// another reload is queued, as it may already have asked the previous instance to stop.
+func (h *HAProxy) startReplacement(ctx context.Context, args []string) (*Cmd, error) {
+	type started struct {
+		cmd *Cmd
+		err error
+	}
+
+	// the process itself lives as long as ctx; only waiting for it is limited
+	result := make(chan started, 1)
+	go func() {
+		if err := h.acquireProc(ctx); err != nil {
+			result <- started{nil, err}
+			return
+		}
+
+		cmd, err := NewCommand(ctx, h.log, cfg.HAProxyBin, args...)
+		h.trackProc(cmd)
+		result <- started{cmd, err}
+	}()
+
+	select {
+	case r := <-result:
+		return r.cmd, r.err
+	case <-time.After(cfg.ReloadTimeout):
+	}
+
+	h.log.Error("replacement did not start in time", zap.Duration("timeout", cfg.ReloadTimeout))
+
+	go func() {
+		r := <-result
+		if r.err != nil {
+			return
+		}
+
+		h.log.Warn("replacement started after timing out; stopping it")
+		r.cmd.Close()
+
+		if ctx.Err() == nil {
+			h.WriteConfig(ctx, true)
+		}
+	}()
+
+	return nil, ErrReloadTimeout
+}
+
+// ReloadWindow returns how long changes are currently collected before HAProxy is reloaded.
+func (h *HAProxy) ReloadWindow() time.Duration {
+	return time.Duration(atomic.LoadInt64(&h.window))
+}
+
+// adaptReloadWindow widens the reload window when reloads follow each other closely, and narrows it again once they
+// don't, so that heavy churn results in fewer, larger reloads instead of a storm of HAProxy processes. since is the time
+// between the last two reloads.
+func (h *HAProxy) adaptReloadWindow(since time.Duration) {
+	window := h.ReloadWindow()
+	next := window
+
+	switch {
+	case since < 2*window:
+		if next *= 2; next > cfg.ReloadMaxDelay {
+			next = cfg.ReloadMaxDelay
+		}
+	case since > 4*window:
+		if next /= 2; next < cfg.ReloadDelay {
+			next = cfg.ReloadDelay
+		}
+	}
+
+	if next == window {
+		return
+	}
+
+	atomic.StoreInt64(&h.window, int64(next))
+
+	switch {
+	case window == cfg.ReloadDelay:
+		h.log.Info("reload backoff engaged", zap.Duration("window", next), zap.Duration("since_last", since))
+	case next == cfg.ReloadDelay:
+		h.log.Info("reload backoff relaxed", zap.Duration("window", next))
+	default:
+		h.log.Debug("reload window adjusted", zap.Duration("window", next), zap.Duration("since_last", since))
+	}
+}
+
+// Command sends a single command to HAProxy's runtime API and returns the response.
+func (h *HAProxy) Command(cmd string) (resp string, err error) {
+	return socketCommand(h.Socket, cmd)
+}
+
+// socketCommand sends a single command to the HAProxy CLI listening on the Unix socket at name and returns the response.
+func socketCommand(name, cmd string) (resp string, err error) {
+	var (
+		conn net.Conn
+		out  []byte
+	)
+
+	if conn, err = net.DialTimeout("unix", name, time.Second); err != nil {
+		return
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = fmt.Fprintf(conn, "%s\n", cmd); err != nil {
+		return
+	}
+
+	// HAProxy closes the connection once it has answered a non-interactive command
+	if out, err = io.ReadAll(conn); err != nil {
+		return
+	}
+
+	return string(out), nil
+}
+
+// AddBackend tells HAProxy that a new Tor+Privoxy backend is available for use on port. The backend starts out with a
+// reduced weight, which is raised once it has had some time to warm up.
+func (h *HAProxy) AddBackend(ctx context.Context, port int, be *Backend) {
+	weight := FULL_WEIGHT
+	if cfg.WarmupTime > 0 {
+		weight = WARMUP_WEIGHT
+	}
+
+	be.Weight = weight
+	be.Added = time.Now()
+
+	h.mu.Lock()
+	h.Backends[port] = be
+	h.mu.Unlock()
+
+	h.log.Debug("adding backend", zap.Int("backend", port), zap.Int64("proxy", be.Proxy))
+	events.Emit(Event{Event: EVENT_BACKEND_ADDED, Port: port, Proxy: be.Proxy, Direct: be.Direct})
+	h.LogMembership()
+
+	h.WriteConfig(ctx, true)
+	WriteStatus()
+
+	if weight != FULL_WEIGHT {
+		go h.WarmUp(ctx, port)
+	} else {
+		events.Emit(Event{Event: EVENT_PROXY_HEALTHY, Port: port, Proxy: be.Proxy})
+	}
+}
+
+// RecordLatency adds the times of a health check of the backend on port to its latency figures.
+func (h *HAProxy) RecordLatency(port int, info *ExitInfo) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if be, ok := h.Backends[port]; ok {
+		be.Latency.Add(info.Connect, info.FirstByte)
+	}
+}
+
+// SetCircuit records the newest circuit of the Tor behind the backend on port. Replacing a circuit that was recorded
+// before counts as the backend's circuit rotating.
+func (h *HAProxy) SetCircuit(port int, circ *Circuit) {
+	var (
+		rotated bool
+		proxy   int64
+	)
+
+	h.mu.Lock()
+	if be, ok := h.Backends[port]; ok {
+		rotated, proxy = be.Circuit != nil, be.Proxy
+		be.Circuit = circ
+	}
+	h.mu.Unlock()
+
+	if rotated {
+		events.Emit(Event{Event: EVENT_CIRCUIT_ROTATED, Port: port, Proxy: proxy, Circuit: circ.String()})
+	}
+
+	WriteStatus()
+}
+
+// WaitLive waits for HAProxy to report the backend on port as up, which it only does once a reload has picked the
+// backend up, giving up after -live-timeout. Nothing is reloaded while HAProxy waits to take over from another process
+// or a new process is taking over from this one, so there is no waiting then.
+func (h *HAProxy) WaitLive(ctx context.Context, port int) error {
+	server := fmt.Sprintf("privoxy-%d", port)
+	timeout := time.After(cfg.LiveTimeout)
+
+	for {
+		if h.TakingOver() || HandingOff() {
+			return nil
+		}
+
+		// HAProxy can't answer while it's being replaced, so errors only mean trying again
+		if stats, err := h.BackendStats(); err == nil {
+			for _, s := range stats {
+				if s.Server == server && (strings.HasPrefix(s.Status, "UP") || s.Status == "no check") {
+					return nil
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ErrTerminating
+		case <-timeout:
+			return ErrNotLive
+		case <-time.After(LIVE_POLL):
+		}
+	}
+}
+
+// TakingOver reports whether HAProxy is still waiting to take over from the process this one replaces.
+func (h *HAProxy) TakingOver() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.takeover != ""
+}
+
+// WarmUp raises a backend to full weight after the warm-up period. The runtime API is used when possible so that
+// HAProxy doesn't need to be reloaded; otherwise the config is rewritten.
+func (h *HAProxy) WarmUp(ctx context.Context, port int) {
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(time.Duration(cfg.WarmupTime) * time.Second):
+	}
+
+	var proxy int64
+
+	h.mu.Lock()
+	be, ok := h.Backends[port]
+	if ok {
+		be.Weight = FULL_WEIGHT
+		proxy = be.Proxy
+	}
+	h.mu.Unlock()
+
+	if !ok {
+		// recycled before it finished warming up
+		return
+	}
+
+	_log := h.log.With(zap.Int("backend", port), zap.Int64("proxy", proxy), zap.Int("weight", FULL_WEIGHT))
+	resp, err := h.Command(fmt.Sprintf("set weight privoxies/privoxy-%d %d", port, FULL_WEIGHT))
+	if err == nil && strings.TrimSpace(resp) == "" {
+		_log.Debug("backend warmed up")
+	} else {
+		_log.Debug("unable to set weight at runtime; reloading", zap.String("response", resp), zap.Error(err))
+		h.WriteConfig(ctx, true)
+	}
+
+	events.Emit(Event{Event: EVENT_PROXY_HEALTHY, Port: port, Proxy: proxy})
+}
+
+// Drain stops HAProxy from sending new connections to the backend on port, then waits for its current connections to
+// finish, up to the drain timeout. The backend's weight stays at zero across reloads so draining isn't undone.
+func (h *HAProxy) Drain(ctx context.Context, port int) error {
+	server := fmt.Sprintf("privoxy-%d", port)
+	_log := h.log.With(zap.Int("backend", port))
+
+	h.mu.Lock()
+	be, ok := h.Backends[port]
+	if ok {
+		be.Draining = true
+		_log = _log.With(zap.Int64("proxy", be.Proxy))
+	}
+	h.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("no backend on port %d", port)
+	}
+
+	resp, err := h.Command(fmt.Sprintf("set server privoxies/%s state drain", server))
+	if err != nil {
+		return err
+	}
+
+	if resp = strings.TrimSpace(resp); resp != "" {
+		return fmt.Errorf("unable to drain %s: %s", server, resp)
+	}
+
+	_log.Info("draining backend")
+
+	timeout := time.After(cfg.DrainTimeout)
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+
+	for {
+		stats, err := h.BackendStats()
+		if err != nil {
+			_log.Debug("unable to check sessions", zap.Error(err))
+		}
+
+		found := false
+		for _, s := range stats {
+			if s.Server != server {
+				continue
+			}
+
+			found = true
+			if s.Sessions == 0 {
+				_log.Info("backend drained")
+				return nil
+			}
+		}
+
+		if err == nil && !found {
+			// already gone
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeout:
+			_log.Warn("backend still has sessions after drain timeout", zap.Duration("timeout", cfg.DrainTimeout))
+			return nil
+		case <-tick.C:
+		}
+	}
+}
+
+// ClaimDirect reports whether a new backend should bypass Tor, which is the case until the pool's share of direct
+// backends is met. A successful claim must be given back with ReleaseDirect once the backend is gone.
+func (h *HAProxy) ClaimDirect() bool {
+	target := int(math.Round(cfg.DirectRatio * float64(h.Size())))
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.direct >= target {
+		return false
+	}
+
+	h.direct++
+	return true
+}
+
+// ReleaseDirect gives back a claim made with ClaimDirect.
+func (h *HAProxy) ReleaseDirect() {
+	h.mu.Lock()
+	h.direct--
+	h.mu.Unlock()
+}
+
+// BackendPorts returns a sorted snapshot of the ports of every backend. Backends is shared with the goroutines that add
+// and remove backends, so anything outside of HAProxy should read it through here.
+func (h *HAProxy) BackendPorts() (ports []int) {
+	h.mu.Lock()
+	for port := range h.Backends {
+		ports = append(ports, port)
+	}
+	h.mu.Unlock()
+
+	sort.Ints(ports)
+
+	return ports
+}
+
+// LogMembership logs a single line listing every backend in the pool: "pool ready" the first time the pool reaches its
+// full size, and "pool changed" whenever its membership changes after that, so the current state is always easy to find.
+func (h *HAProxy) LogMembership() {
+	ports := h.BackendPorts()
+
+	// a fan-out pool only ever has its shared Privoxy
+	want := h.Size()
+	if cfg.FanoutInterval > 0 {
+		want = 1
+	}
+
+	h.mu.Lock()
+	msg := "pool changed"
+	if !h.filled {
+		if len(ports) < want {
+			h.mu.Unlock()
+			return
+		}
+
+		h.filled = true
+		msg = "pool ready"
+	}
+	h.mu.Unlock()
+
+	list := make([]string, len(ports))
+	for i, p := range ports {
+		list[i] = strconv.Itoa(p)
+	}
+
+	h.log.Info(msg,
+		zap.Int("frontend", h.Port),
+		zap.Int("size", len(ports)),
+		zap.Int("target", want),
+		zap.String("backends", strings.Join(list, ",")))
+}
+
+// HealthyBackends returns the number of backends that have finished warming up, not counting the one on port.
+func (h *HAProxy) HealthyBackends(except int) (n int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for port, be := range h.Backends {
+		if port != except && be.Weight == FULL_WEIGHT {
+			n++
+		}
+	}
+
+	return n
+}
+
+// RemoveBackend tells HAProxy that a Tor+Privoxy backend has expired and should be removed from the pool.
+func (h *HAProxy) RemoveBackend(ctx context.Context, port int) {
+	h.mu.Lock()
+	_, known := h.Backends[port]
+	delete(h.Backends, port)
+	h.mu.Unlock()
+
+	// more than one cleanup path may fire for the same backend during shutdown, and only the first should reload
+	if !known {
+		h.log.Debug("not removing unknown backend", zap.Int("port", port))
+		return
+	}
+
+	events.Emit(Event{Event: EVENT_BACKEND_REMOVED, Port: port})
+	h.LogMembership()
+
+	h.WriteConfig(ctx, true)
+	WriteStatus()
+}
+
+// CanTakeOver reports whether enough backends are up for HAProxy to take over from the process being replaced: the
+// whole pool, or just -min-healthy when that is smaller.
+func (h *HAProxy) CanTakeOver() bool {
+	want := h.Size()
+	if cfg.MinHealthy > 0 && cfg.MinHealthy < want {
+		want = cfg.MinHealthy
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return len(h.Backends) >= want
+}
+
+// current returns the running instance of HAProxy, which a reload may replace at any time.
+func (h *HAProxy) current() *Cmd {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.cmd
+}
+
+// Done returns a channel that is closed when the current instance of HAProxy exits. It is never closed while HAProxy
+// is waiting to take over.
+func (h *HAProxy) Done() <-chan struct{} {
+	cmd := h.current()
+	if cmd == nil {
+		return nil
+	}
+
+	return cmd.Done()
+}
+
+func (h *HAProxy) Wait() {
+	cmd := h.current()
+	if cmd == nil {
+		return
+	}
+
+	cmd.Wait()
+}
+
+func (h *HAProxy) Close() (err error) {
+	if h == nil {
+		return nil
+	}
+
+	cmd := h.current()
+	if cmd == nil {
+		return nil
+	}
+
+	defer func() {
+		if err = RemoveData(h.log, "haproxy", h.dir); err != nil {
+			h.log.Error("failed to data directory", zap.String("path", h.dir), zap.Error(err))
+		}
+	}()
+
+	cmd.log.Info("cleaning up")
+	if err = cmd.Close(); err != nil {
+		if !errors.Is(err, ErrProcessKilled) {
+			cmd.log.Error("failed to kill server", zap.Error(err))
+		}
+		return err
+	}
+
+	return nil
+}
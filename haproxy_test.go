@@ -0,0 +1,324 @@
+package torotator
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testHAProxy configures the HAProxy for a pool of count proxies on port without starting it. Backends join at full
+// weight and reloads follow changes quickly.
+func testHAProxy(t *testing.T, port, count int) *HAProxy {
+	t.Helper()
+
+	c := testConfig(t)
+	c.WarmupTime = 0
+	c.ReloadDelay = 10 * time.Millisecond
+	c.ReloadMaxDelay = 50 * time.Millisecond
+
+	h, err := ConfigureHAProxy(&Pool{Port: port, Count: count})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// wait out any reload still under way, which reads the package's config
+	t.Cleanup(func() { h.reloadQ <- true })
+
+	return h
+}
+
+// startTestHAProxy starts the fake HAProxy for a pool of count proxies on port, after letting configure, if not nil,
+// adjust the Config. It is shut down at the end of the test.
+func startTestHAProxy(t *testing.T, port, count int, configure func(*Config)) (*HAProxy, context.Context) {
+	t.Helper()
+
+	c := testConfig(t)
+	c.WarmupTime = 0
+	c.ReloadDelay = 10 * time.Millisecond
+	c.ReloadMaxDelay = 50 * time.Millisecond
+	c.StartupWait = 50 * time.Millisecond
+	c.ReloadTimeout = 5 * time.Second
+	c.HAProxyBin = fakeBin(t, "haproxy")
+
+	if configure != nil {
+		configure(c)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	h, err := NewHAProxy(ctx, &Pool{Port: port, Count: count})
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		cancel()
+
+		// wait out the reload under way, which reads the package's config, and keep any more from starting
+		h.reloadQ <- true
+		h.Close()
+	})
+
+	return h, ctx
+}
+
+// loadedServers returns the ports of the backends the running HAProxy knows about.
+func loadedServers(h *HAProxy) (ports []int, err error) {
+	stats, err := h.Stats()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range stats {
+		var port int
+		if _, err := fmt.Sscanf(s.Server, "privoxy-%d", &port); err == nil {
+			ports = append(ports, port)
+		}
+	}
+
+	sort.Ints(ports)
+
+	return ports, nil
+}
+
+func TestBackendsConcurrentAccess(t *testing.T) {
+	const workers, changes = 8, 20
+
+	// the pool never fills up, so HAProxy is never started
+	h := testHAProxy(t, 18990, 1000)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stop := make(chan struct{})
+	read := make(chan struct{})
+	go func() {
+		defer close(read)
+
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			if ports := h.BackendPorts(); !sort.IntsAreSorted(ports) {
+				t.Errorf("ports out of order: %v", ports)
+			}
+			h.HealthyBackends(0)
+			h.Render(io.Discard)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			for i := 0; i < changes; i++ {
+				port := 20000 + w*changes + i
+				h.AddBackend(ctx, port, &Backend{Proxy: int64(port)})
+				if i%2 == 0 {
+					h.RemoveBackend(ctx, port)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	close(stop)
+	<-read
+
+	if got, want := len(h.BackendPorts()), workers*changes/2; got != want {
+		t.Fatalf("got %d backends; want %d", got, want)
+	}
+}
+
+func TestReloadConverges(t *testing.T) {
+	const workers, changes = 4, 20
+
+	// put back once every reload has finished, which is after HAProxy is shut down
+	slack := reloadTimerSlack
+	reloadTimerSlack = 100 * time.Millisecond
+	t.Cleanup(func() { reloadTimerSlack = slack })
+
+	h, ctx := startTestHAProxy(t, 18991, 1, nil)
+
+	// HAProxy refuses to start with a backend on port 1, so the reloads that include it fail and put the last good config
+	// back while the others carry on changing it
+	stop := make(chan struct{})
+	poisoned := make(chan struct{})
+	go func() {
+		defer close(poisoned)
+
+		for {
+			h.AddBackend(ctx, 1, &Backend{})
+			time.Sleep(20 * time.Millisecond)
+			h.RemoveBackend(ctx, 1)
+
+			select {
+			case <-stop:
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			for i := 0; i < changes; i++ {
+				port := 21000 + w*changes + i
+				h.AddBackend(ctx, port, &Backend{Proxy: int64(port)})
+				if i%2 == 0 {
+					h.RemoveBackend(ctx, port)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	close(stop)
+	<-poisoned
+
+	if got, want := len(h.BackendPorts()), workers*changes/2; got != want {
+		t.Fatalf("got %d backends; want %d", got, want)
+	}
+	waitLoaded(t, h)
+
+	// changes that arrive while HAProxy is refusing a config are loaded once it has given up on it
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.AddBackend(ctx, 1, &Backend{})
+		}()
+
+		time.Sleep(h.ReloadWindow() + 20*time.Millisecond)
+		h.AddBackend(ctx, 22000+i, &Backend{})
+		h.RemoveBackend(ctx, 1)
+		wg.Wait()
+
+		waitLoaded(t, h)
+	}
+
+	// a reload whose timer never fires still loads the changes coalesced into it
+	atomic.StoreInt64(&h.window, int64(time.Second))
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		h.AddBackend(ctx, 22100, &Backend{})
+	}()
+
+	for len(h.reloadQ) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	h.AddBackend(ctx, 22101, &Backend{})
+	h.delay.Stop()
+	wg.Wait()
+
+	waitLoaded(t, h)
+}
+
+// waitLoaded waits for HAProxy to settle on a config with every backend in it, failing the test if it doesn't.
+func waitLoaded(t *testing.T, h *HAProxy) {
+	t.Helper()
+
+	var (
+		got, want []int
+		err       error
+		settled   int
+	)
+	for deadline := time.Now().Add(15 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		want = h.BackendPorts()
+		if got, err = loadedServers(h); err != nil || !reflect.DeepEqual(got, want) || len(h.reloadQ) > 0 {
+			settled = 0
+			continue
+		}
+
+		// a reload may still follow the one that loaded it
+		if settled++; settled == 2 {
+			return
+		}
+	}
+
+	t.Fatalf("HAProxy never loaded every backend: got %v (%v); want %v", got, err, want)
+}
+
+func TestReloadsRespectMaxProcs(t *testing.T) {
+	if _, err := exec.LookPath("pgrep"); err != nil {
+		t.Skip("pgrep is needed to count HAProxy processes")
+	}
+
+	// a master isn't counted, only the workers it runs
+	for _, master := range []bool{false, true} {
+		t.Run(fmt.Sprintf("master-worker=%v", master), func(t *testing.T) {
+			testReloadsRespectMaxProcs(t, master)
+		})
+	}
+}
+
+func testReloadsRespectMaxProcs(t *testing.T, master bool) {
+	const workers = 4
+
+	h, ctx := startTestHAProxy(t, 18993, 1, func(c *Config) {
+		c.HAProxyMaxProcs = 2
+		c.HAProxyMasterWorker = master
+	})
+
+	// the most HAProxy processes seen at once, sampled while reloads are hammered
+	peak := make(chan int)
+	stop := make(chan struct{})
+	go func() {
+		most := 0
+		for {
+			n := len(fakePids(t, "haproxy"))
+			if master {
+				n--
+			}
+			if n > most {
+				most = n
+			}
+
+			select {
+			case <-stop:
+				peak <- most
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); {
+				h.AddBackend(ctx, 23000+w, &Backend{})
+				h.RemoveBackend(ctx, 23000+w)
+			}
+		}(w)
+	}
+	wg.Wait()
+	waitLoaded(t, h)
+
+	close(stop)
+	n := <-peak
+	if n > cap(h.procs) {
+		t.Errorf("%d HAProxy processes at once; want at most %d", n, cap(h.procs))
+	}
+}
@@ -0,0 +1,154 @@
+package torotator
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/uber-go/zap"
+)
+
+// ExitBlacklist remembers exits that repeatedly failed health checks, so that new Tor instances avoid them until their
+// cooldown is over. Exits are known by IP address, which ExcludeExitNodes accepts just like a fingerprint.
+type ExitBlacklist struct {
+	mu    sync.Mutex
+	until map[string]time.Time
+}
+
+// exitBlacklist is shared by every pool.
+var exitBlacklist = &ExitBlacklist{until: make(map[string]time.Time)}
+
+// Add blacklists ip for the exit cooldown.
+func (b *ExitBlacklist) Add(ip string) {
+	if cfg.ExitCooldown <= 0 || ip == "" {
+		return
+	}
+
+	b.mu.Lock()
+	b.until[ip] = time.Now().Add(cfg.ExitCooldown)
+	b.mu.Unlock()
+
+	log.Warn("blacklisting exit", zap.String("ip", ip), zap.Duration("cooldown", cfg.ExitCooldown))
+}
+
+// List returns every exit that is still blacklisted, forgetting those whose cooldown is over.
+func (b *ExitBlacklist) List() (ips []string) {
+	now := time.Now()
+
+	b.mu.Lock()
+	for ip, until := range b.until {
+		if now.After(until) {
+			delete(b.until, ip)
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	b.mu.Unlock()
+
+	sort.Strings(ips)
+
+	return ips
+}
+
+// MonitorExit probes the exit of tor through -check-url every health interval. The returned channel is closed once
+// -health-failures probes in a row have failed, at which point the last exit seen is blacklisted. It is never closed if
+// health checks are disabled or Tor has no TCP SOCKS port to probe through.
+func MonitorExit(ctx context.Context, _log zap.Logger, tor *Tor) <-chan struct{} {
+	unhealthy, _ := MonitorProxy(ctx, _log, tor, nil, nil)
+	return unhealthy
+}
+
+// MonitorProxy is like MonitorExit, but probes through privoxy when it isn't nil, which tests the whole chain. Once the
+// probes have failed often enough, Tor is checked on its own with ProbeSocks. If Tor is fine, the second channel
+// receives a value instead, meaning that only Privoxy needs replacing, and probing carries on. Every successful probe
+// is passed to probed, if it isn't nil.
+func MonitorProxy(ctx context.Context, _log zap.Logger, tor *Tor, privoxy *Privoxy, probed func(*ExitInfo)) (<-chan struct{}, <-chan struct{}) {
+	unhealthy := make(chan struct{})
+	privoxyFailed := make(chan struct{}, 1)
+	if tor == nil || tor.TCPPort() == 0 || cfg.HealthInterval <= 0 {
+		return unhealthy, privoxyFailed
+	}
+
+	via := &url.URL{Scheme: "socks5", Host: tor.SocksAddress()}
+	if privoxy != nil {
+		via = &url.URL{Scheme: "http", Host: fmt.Sprintf("127.0.0.1:%d", privoxy.port)}
+	}
+
+	go func() {
+		// a probe in flight is abandoned as soon as the proxy is torn down, not just when torotator shuts down
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go func() {
+			select {
+			case <-ctx.Done():
+			case <-tor.Done():
+				cancel()
+			}
+		}()
+
+		t := time.NewTicker(cfg.HealthInterval)
+		defer t.Stop()
+
+		var (
+			exit     string
+			failures int
+		)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+
+			info, err := ProbeExit(ctx, via)
+			if err == nil {
+				exit, failures = info.IP, 0
+				_log.Debug("exit healthy",
+					zap.String("exit", exit),
+					zap.Duration("latency", info.Latency),
+					zap.Duration("connect", info.Connect),
+					zap.Duration("first_byte", info.FirstByte))
+				if probed != nil {
+					probed(info)
+				}
+				continue
+			}
+
+			if ctx.Err() != nil {
+				return
+			}
+
+			failures++
+			_log.Warn("exit health check failed", zap.String("exit", exit), zap.Int("failures", failures), zap.Error(err))
+			if failures < cfg.HealthFailures {
+				continue
+			}
+
+			// Privoxy may be the one failing rather than Tor
+			if privoxy != nil {
+				latency, err := ProbeSocks(ctx, tor.SocksAddress())
+				if err == nil {
+					_log.Warn("tor is healthy on its own; replacing privoxy", zap.Duration("latency", latency))
+					failures = 0
+					select {
+					case privoxyFailed <- struct{}{}:
+					default:
+					}
+					continue
+				}
+
+				_log.Warn("tor failed socks check", zap.Error(err))
+			}
+
+			exitBlacklist.Add(exit)
+			close(unhealthy)
+			return
+		}
+	}()
+
+	return unhealthy, privoxyFailed
+}
@@ -0,0 +1,116 @@
+package torotator
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakePids returns the pids of the running processes started from the fake named bin, or from any fake when bin is "".
+func fakePids(t *testing.T, bin string) []string {
+	t.Helper()
+
+	pattern := "^" + fakes.dir + "/"
+	if bin != "" {
+		pattern += bin + " "
+	}
+
+	// pgrep exits with 1 when nothing matches
+	out, _ := exec.Command("pgrep", "-f", pattern).Output()
+
+	return strings.Fields(string(out))
+}
+
+// waitFor polls cond until it holds, failing the test with what it was waiting for if that takes longer than timeout.
+func waitFor(t *testing.T, what string, timeout time.Duration, cond func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(timeout); !cond(); time.Sleep(100 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+	}
+}
+
+// TestIntegration runs a pool against the stand-ins for Tor, Privoxy and HAProxy, checking that it fills up, has its
+// proxies recycled, never runs more HAProxy processes than -haproxy-max-procs allows, and shuts down without leaving
+// anything behind.
+func TestIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs the fake services")
+	}
+	if _, err := exec.LookPath("pgrep"); err != nil {
+		t.Skip("pgrep is needed to follow the fake services")
+	}
+
+	c := testConfig(t)
+	c.TorBin = fakeBin(t, "tor")
+	c.PrivoxyBin = fakeBin(t, "privoxy")
+	c.HAProxyBin = fakeBin(t, "haproxy")
+	c.ProxyPort = 18080
+	c.PortRangeStart, c.PortRangeEnd = 31000, 31100
+	c.TorCount = 3
+	c.MaxProxyTime = 5
+	c.WarmupTime = 0
+	c.ReloadDelay = 100 * time.Millisecond
+	c.HAProxyMaxProcs = 2
+
+	m, err := NewManager(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err = m.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// the most HAProxy processes seen at once, sampled for as long as the pool runs
+	peak := make(chan int)
+	stopped := make(chan struct{})
+	go func() {
+		most := 0
+		for {
+			if n := len(fakePids(t, "haproxy")); n > most {
+				most = n
+			}
+
+			select {
+			case <-stopped:
+				peak <- most
+				return
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+	}()
+
+	waitFor(t, "the pool fills up", 30*time.Second, func() bool {
+		return len(m.Backends()[c.ProxyPort]) >= c.TorCount
+	})
+
+	waitFor(t, "proxies are recycled", 30*time.Second, func() bool {
+		for _, p := range CurrentStatus().Pools {
+			for _, r := range p.Recycled {
+				if r.Reason == RECYCLE_EXPIRED {
+					return true
+				}
+			}
+		}
+		return false
+	})
+
+	m.Stop()
+	close(stopped)
+
+	if n := <-peak; n > c.HAProxyMaxProcs {
+		t.Errorf("%d HAProxy processes at once; want at most %d", n, c.HAProxyMaxProcs)
+	}
+
+	if left := fakePids(t, ""); len(left) > 0 {
+		t.Errorf("processes left behind: %v", left)
+	}
+}
@@ -0,0 +1,82 @@
+package torotator
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// LATENCY_SAMPLES is how many of a backend's most recent health checks its latency figures are drawn from.
+const LATENCY_SAMPLES = 20
+
+// Latency keeps the connect and first-byte times of a backend's most recent health checks. Connect covers everything
+// up to having a connection to the check URL's host through the circuit, and first byte the time from sending the
+// request to the start of the response.
+type Latency struct {
+	connect   []time.Duration
+	firstByte []time.Duration
+}
+
+// LatencyStatus summarizes a backend's Latency for the status file, in seconds.
+type LatencyStatus struct {
+	Samples      int     `json:"samples"`
+	Connect      float64 `json:"connect"`
+	ConnectP50   float64 `json:"connect_p50"`
+	ConnectP90   float64 `json:"connect_p90"`
+	FirstByte    float64 `json:"first_byte"`
+	FirstByteP50 float64 `json:"first_byte_p50"`
+	FirstByteP90 float64 `json:"first_byte_p90"`
+}
+
+// Add records the times of a health check, forgetting the oldest once there are more than LATENCY_SAMPLES.
+func (l *Latency) Add(connect, firstByte time.Duration) {
+	l.connect = appendSample(l.connect, connect)
+	l.firstByte = appendSample(l.firstByte, firstByte)
+}
+
+// Status summarizes the samples, or returns nil if there are none yet.
+func (l *Latency) Status() *LatencyStatus {
+	if l == nil || len(l.connect) == 0 {
+		return nil
+	}
+
+	last := len(l.connect) - 1
+	return &LatencyStatus{
+		Samples:      len(l.connect),
+		Connect:      l.connect[last].Seconds(),
+		ConnectP50:   percentile(l.connect, 50).Seconds(),
+		ConnectP90:   percentile(l.connect, 90).Seconds(),
+		FirstByte:    l.firstByte[last].Seconds(),
+		FirstByteP50: percentile(l.firstByte, 50).Seconds(),
+		FirstByteP90: percentile(l.firstByte, 90).Seconds(),
+	}
+}
+
+// appendSample adds d to samples, dropping the oldest beyond LATENCY_SAMPLES.
+func appendSample(samples []time.Duration, d time.Duration) []time.Duration {
+	samples = append(samples, d)
+	if n := len(samples); n > LATENCY_SAMPLES {
+		samples = samples[n-LATENCY_SAMPLES:]
+	}
+
+	return samples
+}
+
+// percentile returns the p-th percentile of samples by the nearest-rank method, or 0 when there are none.
+func percentile(samples []time.Duration, p float64) time.Duration {
+	if len(samples) == 0 {
+		return 0
+	}
+
+	sorted := append([]time.Duration{}, samples...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+
+	return sorted[rank-1]
+}
@@ -0,0 +1,262 @@
+package torotator
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/uber-go/zap"
+)
+
+// Manager runs every pool: one HAProxy per pool, with Tor+Privoxy pairs rotating behind each. Only one Manager may
+// exist per process, since the port allocator, status file and the like are shared by every pool.
+type Manager struct {
+	pools     PoolList
+	haproxies []*HAProxy
+	ctx       context.Context
+	cancel    context.CancelFunc
+
+	// rotators tracks each pool's Rotate loop, and proxies every Tor+Privoxy pair they start
+	rotators sync.WaitGroup
+	proxies  sync.WaitGroup
+}
+
+// NewManager checks c and prepares a Manager for the pools it describes without starting anything. The Manager keeps
+// using c, which must not be changed afterwards other than as described for Reload.
+func NewManager(c *Config) (m *Manager, err error) {
+	if err = c.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %v", err)
+	}
+
+	if c.Log == nil {
+		c.Log = DefaultConfig().Log
+	}
+	cfg, log = c, c.Log
+
+	if takeovers, err = ParseTakeovers(os.Getenv(UPGRADE_ENV)); err != nil {
+		return nil, fmt.Errorf("invalid upgrade handoff: %v", err)
+	}
+	// only meant for us, not for anything we start
+	os.Unsetenv(UPGRADE_ENV)
+	SetupRunDir()
+
+	if pinnedPorts, err = ParsePortList(c.PortList); err != nil {
+		return nil, fmt.Errorf("invalid port list: %v", err)
+	}
+
+	networks, err := ParseNetworks(c.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allowed networks: %v", err)
+	}
+	setTuned(c, networks)
+
+	if pools, err = Pools(); err != nil {
+		return nil, fmt.Errorf("invalid pool configuration: %v", err)
+	}
+
+	if extraSocksFlags, err = ParseSocksFlags(c.SocksFlags); err != nil {
+		return nil, fmt.Errorf("invalid SocksPort flags: %v", err)
+	}
+
+	if err = LookupHAProxyUser(); err != nil {
+		return nil, fmt.Errorf("invalid HAProxy user: %v", err)
+	}
+
+	if err = ReadHAProxyExtra(); err != nil {
+		return nil, fmt.Errorf("unable to read extra HAProxy config: %v", err)
+	}
+
+	if guardNodes, err = ParseNodes(c.EntryNodes); err != nil {
+		return nil, fmt.Errorf("invalid entry nodes: %v", err)
+	}
+
+	if err = CheckNodes(guardNodes, pools); err != nil {
+		return nil, fmt.Errorf("conflicting entry and exit nodes: %v", err)
+	}
+
+	if err = ValidatePorts(pools); err != nil {
+		return nil, fmt.Errorf("not enough ports: %v", err)
+	}
+
+	if c.BootstrapConcurrency > 0 {
+		bootstrapSlots = make(chan struct{}, c.BootstrapConcurrency)
+	}
+
+	SeedRandom(c.Seed)
+
+	ports = make(map[int]int)
+	RestorePortState()
+
+	return &Manager{pools: pools}, nil
+}
+
+// Start checks the programs torotator depends on, launches an HAProxy for each pool and begins rotating proxies behind
+// them, returning once every HAProxy is up. Everything keeps running until ctx is canceled or Stop is called.
+func (m *Manager) Start(ctx context.Context) (err error) {
+	if err = FindDependencies(); err != nil {
+		return err
+	}
+
+	// anything already in the data directory belongs to the process we're taking over from
+	if !Upgrading() {
+		ReapOrphans(cfg.DataDir)
+	}
+
+	if cfg.PprofPort > 0 {
+		go ServePprof(cfg.PprofPort)
+	}
+
+	if cfg.SharedCache {
+		if torCache, err = NewTorCache(path.Join(cfg.DataDir, "cache")); err != nil {
+			return fmt.Errorf("failed to set up the shared tor cache: %v", err)
+		}
+	}
+
+	if cfg.EventsFile != "" {
+		if events, err = OpenEventLog(cfg.EventsFile); err != nil {
+			return fmt.Errorf("failed to open event log %s: %v", cfg.EventsFile, err)
+		}
+	}
+
+	m.ctx, m.cancel = context.WithCancel(ctx)
+	ctx = m.ctx
+
+	// every pool gets its own HAProxy, but they all share the port allocator
+	for _, pool := range m.pools {
+		ha, err := m.startHAProxy(ctx, pool)
+		if err != nil {
+			m.Stop()
+			return fmt.Errorf("failed to start HAProxy on port %d: %v", pool.Port, err)
+		}
+
+		go ha.Wait()
+
+		if cfg.StatsInterval > 0 {
+			go LogStats(ctx, ha, cfg.StatsInterval)
+		}
+
+		m.haproxies = append(m.haproxies, ha)
+	}
+
+	// the status file and admin API report on every pool
+	haproxies = m.haproxies
+
+	for _, ha := range m.haproxies {
+		m.rotators.Add(1)
+		go func(ha *HAProxy) {
+			Rotate(ctx, &m.proxies, ha)
+			m.rotators.Done()
+		}(ha)
+	}
+
+	go StatusLoop(ctx)
+
+	if cfg.AdminAddr != "" {
+		go ServeAdmin(ctx, cfg.AdminAddr)
+	}
+
+	return nil
+}
+
+// startHAProxy starts the HAProxy for pool, retrying with backoff so that a port briefly held over from a previous
+// instance doesn't bring torotator down.
+func (m *Manager) startHAProxy(ctx context.Context, pool *Pool) (ha *HAProxy, err error) {
+	b := &Backoff{Min: time.Second, Max: 10 * time.Second}
+
+	for {
+		if ha, err = NewHAProxy(ctx, pool); err == nil {
+			return ha, nil
+		}
+
+		delay := b.Next()
+		if b.Attempts() >= cfg.HAProxyAttempts {
+			return nil, fmt.Errorf("gave up after %d attempts: %v", b.Attempts(), err)
+		}
+
+		log.Warn("failed to start HAProxy; retrying",
+			zap.Int("port", pool.Port),
+			zap.Int("attempt", b.Attempts()),
+			zap.Duration("backoff", delay),
+			zap.Error(err))
+		if err = Sleep(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Wait blocks until every pool has stopped rotating and every proxy has shut down.
+func (m *Manager) Wait() {
+	m.rotators.Wait()
+	m.proxies.Wait()
+}
+
+// Stop shuts down every proxy, waits for them to finish, and then stops each HAProxy and cleans up after them.
+func (m *Manager) Stop() {
+	if m.cancel != nil {
+		m.cancel()
+	}
+
+	m.Wait()
+
+	for _, ha := range m.haproxies {
+		ha.Close()
+	}
+
+	// the process that took over is ready in our place
+	if !HandingOff() {
+		SetReady(nil, false)
+	}
+
+	events.Close()
+
+	if runDir != cfg.DataDir {
+		RemoveData(log, "", runDir)
+	}
+}
+
+// Reload applies the settings in next that may change while running, such as timeouts and connection limits, and every
+// HAProxy reloads with them, keeping its current backends. next is meant to be a copy of the Manager's Config with those
+// settings changed, as the rest of it is ignored. Nothing is applied if next is invalid, and next must not be changed
+// afterwards.
+func (m *Manager) Reload(next *Config) error {
+	if err := next.Validate(); err != nil {
+		return err
+	}
+
+	networks, err := ParseNetworks(next.Allow)
+	if err != nil {
+		return err
+	}
+	setTuned(next, networks)
+
+	for _, ha := range m.haproxies {
+		ha.Tune()
+		go ha.WriteConfig(m.ctx, true)
+	}
+
+	return nil
+}
+
+// RecycleAll recycles every proxy in every pool, one at a time with -recycle-stagger in between, so that fresh circuits
+// are built.
+func (m *Manager) RecycleAll(ctx context.Context) {
+	recycler.RecycleAll(ctx, cfg.RecycleStagger)
+}
+
+// HAProxies returns the HAProxy instance of each pool.
+func (m *Manager) HAProxies() []*HAProxy {
+	return m.haproxies
+}
+
+// Backends returns the Privoxy ports of the backends currently in each pool, keyed by the pool's port.
+func (m *Manager) Backends() map[int][]int {
+	out := make(map[int][]int)
+	for _, ha := range m.haproxies {
+		out[ha.Port] = ha.BackendPorts()
+	}
+
+	return out
+}
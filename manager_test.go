@@ -0,0 +1,79 @@
+package torotator
+
+import (
+	"context"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReloadAppliesCopy(t *testing.T) {
+	h := testHAProxy(t, 18995, 4)
+	m := &Manager{haproxies: []*HAProxy{h}, ctx: context.Background()}
+
+	// the config keeps being tuned and rendered while the settings are replaced
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	tuning := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			h.Tune()
+			h.Render(io.Discard)
+			if i == 0 {
+				close(tuning)
+			}
+		}
+	}()
+	<-tuning
+
+	next := *cfg
+	next.MaxConn = 400
+	next.Allow = "10.0.0.0/8"
+	if err := m.Reload(&next); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing is applied from an invalid config
+	bad := next
+	bad.MaxConn = 0
+	bad.Allow = "192.168.0.0/16"
+	if err := m.Reload(&bad); err == nil {
+		t.Fatal("expected an invalid config to be refused")
+	}
+
+	close(stop)
+	<-done
+
+	if cfg.MaxConn == next.MaxConn {
+		t.Error("the Manager's Config was changed")
+	}
+
+	h.Tune()
+	h.mu.Lock()
+	maxConn, serverMaxConn, allow := h.MaxConn, h.ServerMaxConn, h.Allow
+	h.mu.Unlock()
+
+	if maxConn != 400 || serverMaxConn != 100 || !reflect.DeepEqual(allow, []string{"10.0.0.0/8"}) {
+		t.Fatalf("got maxconn %d, server maxconn %d, allow %v; want 400, 100 and [10.0.0.0/8]", maxConn, serverMaxConn, allow)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if raw, err := os.ReadFile(h.conf); err == nil && strings.Contains(string(raw), "maxconn 400") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the config was never rewritten with the new settings")
+		}
+	}
+}
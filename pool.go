@@ -0,0 +1,252 @@
+package torotator
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Pool describes one independent set of rotating proxies, served by its own instance of HAProxy.
+type Pool struct {
+	// Port is the HTTP proxy port clients connect to.
+	Port int
+
+	// Count is the number of Tor+Privoxy pairs kept in rotation.
+	Count int
+
+	// Countries optionally restricts the exit nodes used by every Tor instance in the pool, using ISO country codes
+	// such as "us" or "de".
+	Countries []string
+
+	// Weights, when set, holds a weight for each of Countries. Each Tor instance is then restricted to a single country,
+	// picked at random in proportion to its weight, rather than to all of them.
+	Weights []int
+
+	// StatsPort, if non-zero, is where this pool's HAProxy serves its stats page.
+	StatsPort int
+}
+
+// PoolList collects the repeatable -pool flag.
+type PoolList []*Pool
+
+func (l *PoolList) String() string {
+	var specs []string
+	for _, p := range *l {
+		specs = append(specs, p.String())
+	}
+
+	return strings.Join(specs, " ")
+}
+
+// Set parses a pool specification of the form PORT:COUNT[:CC,CC,...] and adds it to the list.
+func (l *PoolList) Set(spec string) error {
+	p, err := ParsePool(spec)
+	if err != nil {
+		return err
+	}
+
+	*l = append(*l, p)
+
+	return nil
+}
+
+// String renders the pool in the same format accepted by ParsePool.
+func (p *Pool) String() string {
+	spec := fmt.Sprintf("%d:%d", p.Port, p.Count)
+	if len(p.Countries) > 0 {
+		spec += ":" + FormatCountries(p.Countries, p.Weights)
+	}
+
+	return spec
+}
+
+// ExitCountries returns the countries a new Tor instance in the pool may exit from. For a weighted pool, that is a
+// single country picked according to the weights, or with equal odds if every weight is zero.
+func (p *Pool) ExitCountries() []string {
+	if p.Weights == nil {
+		return p.Countries
+	}
+
+	total := p.totalWeight()
+	if total == 0 {
+		i := int(randInt63n(int64(len(p.Countries))))
+		return p.Countries[i : i+1]
+	}
+
+	n := int(randInt63n(int64(total)))
+	for i, w := range p.Weights {
+		if n < w {
+			return p.Countries[i : i+1]
+		}
+		n -= w
+	}
+
+	// not reached
+	return p.Countries
+}
+
+// Pins reports whether a Tor instance in the pool may be restricted to exiting in cc alone.
+func (p *Pool) Pins(cc string) bool {
+	if p.Weights == nil {
+		return len(p.Countries) == 1 && p.Countries[0] == cc
+	}
+
+	total := p.totalWeight()
+	for i, c := range p.Countries {
+		if c == cc && (p.Weights[i] > 0 || total == 0) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// totalWeight adds up the weights of a weighted pool's countries.
+func (p *Pool) totalWeight() (total int) {
+	for _, w := range p.Weights {
+		total += w
+	}
+
+	return total
+}
+
+// Uses reports whether any pool listens on port, either for its frontend or its stats.
+func (l PoolList) Uses(port int) bool {
+	for _, p := range l {
+		if p.Port == port || p.StatsPort == port {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParsePool parses a pool specification of the form PORT:COUNT[:CC,CC,...], e.g. "8081:3:de,nl". Countries may be
+// weighted as with ParseWeightedCountries, e.g. "8081:10:us:50,de:30,nl:20".
+func ParsePool(spec string) (p *Pool, err error) {
+	parts := strings.SplitN(spec, ":", 3)
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("pool %q should look like PORT:COUNT[:CC,CC,...]", spec)
+	}
+
+	p = new(Pool)
+	if p.Port, err = strconv.Atoi(parts[0]); err != nil || p.Port <= 0 || p.Port >= 65536 {
+		return nil, fmt.Errorf("pool %q has an invalid port", spec)
+	}
+
+	if p.Count, err = strconv.Atoi(parts[1]); err != nil || p.Count <= 0 {
+		return nil, fmt.Errorf("pool %q has an invalid count", spec)
+	}
+
+	if len(parts) == 3 {
+		if p.Countries, p.Weights, err = ParseWeightedCountries(parts[2]); err != nil {
+			return nil, fmt.Errorf("pool %q: %v", spec, err)
+		}
+	}
+
+	return p, nil
+}
+
+// ParseCountries parses a comma-separated list of two-letter country codes.
+func ParseCountries(list string) (out []string, err error) {
+	for _, cc := range strings.Split(list, ",") {
+		if cc = strings.ToLower(strings.TrimSpace(cc)); cc == "" {
+			continue
+		}
+
+		if len(cc) != 2 || strings.Trim(cc, "abcdefghijklmnopqrstuvwxyz") != "" {
+			return nil, fmt.Errorf("invalid country code %q", cc)
+		}
+
+		out = append(out, cc)
+	}
+
+	return out, nil
+}
+
+// ParseWeightedCountries parses a comma-separated list of two-letter country codes, each of which may be given a
+// non-negative weight as CC:WEIGHT, e.g. "us:50,de:30,nl:20". Either every country has a weight or none do, in which case
+// weights is nil.
+func ParseWeightedCountries(list string) (countries []string, weights []int, err error) {
+	var codes []string
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+
+		cc, weight := entry, ""
+		if colon := strings.Index(entry, ":"); colon >= 0 {
+			cc, weight = strings.TrimSpace(entry[:colon]), strings.TrimSpace(entry[colon+1:])
+
+			w, err := strconv.Atoi(weight)
+			if err != nil || w < 0 {
+				return nil, nil, fmt.Errorf("invalid weight %q for %q; expected a non-negative number", weight, cc)
+			}
+			weights = append(weights, w)
+		}
+
+		if cc == "" {
+			return nil, nil, fmt.Errorf("missing country code in %q", entry)
+		}
+
+		codes = append(codes, cc)
+	}
+
+	if weights != nil && len(weights) != len(codes) {
+		return nil, nil, fmt.Errorf("either every country needs a weight or none may have one")
+	}
+
+	if countries, err = ParseCountries(strings.Join(codes, ",")); err != nil {
+		return nil, nil, err
+	}
+
+	return countries, weights, nil
+}
+
+// FormatCountries renders countries, along with their weights if there are any, in the form ParseWeightedCountries
+// accepts.
+func FormatCountries(countries []string, weights []int) string {
+	if weights == nil {
+		return strings.Join(countries, ",")
+	}
+
+	var entries []string
+	for i, cc := range countries {
+		entries = append(entries, fmt.Sprintf("%s:%d", cc, weights[i]))
+	}
+
+	return strings.Join(entries, ",")
+}
+
+// Pools returns the configured pools. Without any -pool flags, a single pool is built from -p, -c and -exit-countries.
+// Each pool's HAProxy gets its own stats port, counting up from -stats.
+func Pools() (pools PoolList, err error) {
+	pools = cfg.Pools
+	if len(pools) == 0 {
+		p := &Pool{Port: cfg.ProxyPort, Count: cfg.TorCount}
+		if p.Countries, p.Weights, err = ParseWeightedCountries(cfg.ExitCountries); err != nil {
+			return nil, err
+		}
+
+		pools = PoolList{p}
+	}
+
+	seen := make(map[int]bool)
+	for i, p := range pools {
+		if seen[p.Port] {
+			return nil, fmt.Errorf("more than one pool uses port %d", p.Port)
+		}
+		seen[p.Port] = true
+
+		// a single static proxy per pool
+		if cfg.Once {
+			p.Count = 1
+		}
+
+		if cfg.StatsPort > 0 {
+			p.StatsPort = cfg.StatsPort + i
+		}
+	}
+
+	return pools, nil
+}
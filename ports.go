@@ -0,0 +1,405 @@
+package torotator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uber-go/zap"
+)
+
+var (
+	ports    map[int]int
+	careful  sync.Mutex
+	nextPort int
+
+	// stateMu keeps saves of the port state in order without holding careful during the I/O
+	stateMu sync.Mutex
+
+	// pinnedPorts, when set, is the only set of ports handed out, in order
+	pinnedPorts []int
+	nextPinned  int
+
+	// wraps counts how many times the candidates have been cycled through, and skipped how many candidates were passed
+	// over because they were taken
+	wraps   int
+	skipped int
+)
+
+// PortStats describes the state of the port allocator.
+type PortStats struct {
+	NextPort  int  `json:"next_port"`
+	Allocated int  `json:"allocated"`
+	Free      int  `json:"free"`
+	Wraps     int  `json:"wraps"`
+	Skipped   int  `json:"skipped"`
+	Exhausted bool `json:"exhausted"`
+}
+
+// CurrentPortStats takes a snapshot of the port allocator. Free counts candidates that haven't been handed out, whether
+// or not something else is listening on them.
+func CurrentPortStats() PortStats {
+	careful.Lock()
+	defer careful.Unlock()
+
+	st := PortStats{
+		NextPort:  nextPort,
+		Allocated: len(ports),
+		Free:      candidateCount() - len(ports),
+		Wraps:     wraps,
+		Skipped:   skipped,
+		Exhausted: exhaustion.Active(),
+	}
+
+	if len(pinnedPorts) > 0 {
+		st.NextPort = pinnedPorts[nextPinned]
+	}
+
+	if st.Free < 0 {
+		st.Free = 0
+	}
+
+	return st
+}
+
+// portPlz hands out the next port that is neither handed out already nor in use by something else, returning
+// ErrNoFreePort if there is no such port. The port stays reserved until releasePorts is called for it.
+func portPlz() (int, error) {
+	// deferred first so it runs once careful has been unlocked
+	defer savePortState()
+
+	careful.Lock()
+	defer careful.Unlock()
+
+	// skip anything we've already handed out or that something else is listening on. Tor and Privoxy only ever
+	// listen on the IPv4 loopback.
+	for tries := 0; tries < candidateCount(); tries++ {
+		p := nextCandidate()
+		if _, taken := ports[p]; !taken && portAvailable("tcp4", "127.0.0.1", p) {
+			ports[p] = 0
+			return p, nil
+		}
+
+		skipped++
+		log.Debug("skipping unavailable port", zap.Int("port", p))
+	}
+
+	return 0, ErrNoFreePort
+}
+
+const (
+	// PORT_BACKOFF_MIN and PORT_BACKOFF_MAX bound how long new proxies are held back while no port is free.
+	PORT_BACKOFF_MIN = time.Second
+	PORT_BACKOFF_MAX = time.Minute
+)
+
+// Exhaustion holds back new proxies while every port is taken, rather than letting them fail as fast as they can be
+// started, and raises the alarm until ports free up again.
+type Exhaustion struct {
+	mu      sync.Mutex
+	backoff Backoff
+	since   time.Time
+	until   time.Time
+}
+
+// exhaustion tracks the shortage of ports shared by every pool.
+var exhaustion = new(Exhaustion)
+
+// Check records the outcome of starting a proxy's services. An err of ErrNoFreePort starts or extends the backoff,
+// while success ends it; any other error says nothing about ports either way.
+func (e *Exhaustion) Check(err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := time.Now()
+	switch {
+	case errors.Is(err, ErrNoFreePort):
+		// everything that failed during the same backoff counts as one attempt
+		if now.Before(e.until) {
+			return
+		}
+
+		if e.since.IsZero() {
+			e.since = now
+			e.backoff = Backoff{Min: PORT_BACKOFF_MIN, Max: PORT_BACKOFF_MAX}
+		}
+
+		delay := e.backoff.Next()
+		e.until = now.Add(delay)
+
+		log.Error("port exhaustion; holding back new proxies",
+			zap.Int("candidates", candidateCount()),
+			zap.Int("attempts", e.backoff.Attempts()),
+			zap.Duration("since", now.Sub(e.since)),
+			zap.Duration("retry_in", delay))
+
+	case err == nil && !e.since.IsZero():
+		log.Info("ports available again; resuming", zap.Duration("after", now.Sub(e.since)))
+		e.since, e.until = time.Time{}, time.Time{}
+	}
+}
+
+// Active reports whether new proxies are being held back for want of a port.
+func (e *Exhaustion) Active() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return !e.since.IsZero()
+}
+
+// Wait blocks until the current backoff, if any, is over, returning early with the context's error if ctx is canceled.
+func (e *Exhaustion) Wait(ctx context.Context) error {
+	e.mu.Lock()
+	until := e.until
+	e.mu.Unlock()
+
+	if d := time.Until(until); d > 0 {
+		return Sleep(ctx, d)
+	}
+
+	return nil
+}
+
+// portState is what the port allocator remembers across restarts, so that a quick restart doesn't hand out ports that
+// processes from the previous run may still be holding.
+type portState struct {
+	NextPort   int `json:"next_port"`
+	NextPinned int `json:"next_pinned"`
+}
+
+// PortStateFile returns the path of the file the port allocator's position is kept in.
+func PortStateFile() string {
+	return path.Join(cfg.DataDir, "ports.json")
+}
+
+// RestorePortState picks up the port allocator where the previous run left off, ignoring anything that doesn't fit the
+// current port range or list.
+func RestorePortState() {
+	raw, err := os.ReadFile(PortStateFile())
+	if err != nil {
+		return
+	}
+
+	var st portState
+	if err = json.Unmarshal(raw, &st); err != nil {
+		log.Warn("ignoring unreadable port state", zap.String("path", PortStateFile()), zap.Error(err))
+		return
+	}
+
+	careful.Lock()
+	defer careful.Unlock()
+
+	if st.NextPort >= cfg.PortRangeStart && st.NextPort < cfg.PortRangeEnd {
+		nextPort = st.NextPort
+	}
+
+	if st.NextPinned >= 0 && st.NextPinned < len(pinnedPorts) {
+		nextPinned = st.NextPinned
+	}
+
+	log.Debug("restored port state", zap.Int("next_port", nextPort), zap.Int("next_pinned", nextPinned))
+}
+
+// savePortState records the port allocator's position. The caller must not hold careful.
+func savePortState() {
+	if cfg.DryRun {
+		return
+	}
+
+	// snapshotting while holding stateMu means a later save never writes an older position
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	careful.Lock()
+	raw, _ := json.Marshal(portState{NextPort: nextPort, NextPinned: nextPinned})
+	careful.Unlock()
+
+	name := PortStateFile()
+	tmp := name + ".tmp"
+	err := os.MkdirAll(cfg.DataDir, 0755)
+	if err == nil {
+		err = os.WriteFile(tmp, raw, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+
+	if err != nil {
+		log.Warn("failed to save port state", zap.String("path", name), zap.Error(err))
+	}
+}
+
+// nextCandidate returns the next port to consider, cycling through either the pinned ports or the port range. The
+// caller must hold careful.
+func nextCandidate() (p int) {
+	if len(pinnedPorts) > 0 {
+		p = pinnedPorts[nextPinned]
+		if nextPinned = (nextPinned + 1) % len(pinnedPorts); nextPinned == 0 {
+			wraps++
+		}
+		return p
+	}
+
+	if nextPort == 0 || nextPort >= cfg.PortRangeEnd {
+		if nextPort != 0 {
+			wraps++
+		}
+		nextPort = cfg.PortRangeStart
+		log.Info("setting next port", zap.Int("port", nextPort))
+	}
+
+	p = nextPort
+	nextPort++
+
+	return p
+}
+
+// candidateCount returns how many distinct ports portPlz may choose from.
+func candidateCount() int {
+	if len(pinnedPorts) > 0 {
+		return len(pinnedPorts)
+	}
+
+	return cfg.PortRangeEnd - cfg.PortRangeStart
+}
+
+// portsPerProxy returns the number of ports each Tor+Privoxy pair consumes: one for Privoxy, unless the pool shares a
+// single Privoxy, plus one for Tor's SOCKS port unless it listens on a Unix socket.
+func portsPerProxy() (n int) {
+	if cfg.FanoutInterval == 0 {
+		n++
+	}
+
+	if !cfg.TorSocket {
+		n++
+	}
+
+	return n
+}
+
+// ValidatePorts makes sure there are enough ports to run every pool at full size, including warm spares, which only
+// need a port for Tor.
+func ValidatePorts(pools PoolList) error {
+	if len(pinnedPorts) == 0 && (cfg.PortRangeStart <= 0 || cfg.PortRangeEnd > 65535 || cfg.PortRangeStart >= cfg.PortRangeEnd) {
+		return fmt.Errorf("invalid port range %d-%d", cfg.PortRangeStart, cfg.PortRangeEnd)
+	}
+
+	needed := 0
+	for _, p := range pools {
+		needed += p.Count * portsPerProxy()
+		if cfg.FanoutInterval > 0 {
+			// the shared Privoxy
+			needed++
+		}
+		if cfg.MinHealthy > 0 {
+			// expired proxies may linger alongside their replacements
+			needed += p.Count * portsPerProxy()
+		}
+		if !cfg.TorSocket {
+			needed += cfg.WarmSpares * cfg.SocksPorts
+
+			// a Tor holds on to the SocksPorts of proxies that have ended for as long as any of its others is running
+			needed += p.Count * (cfg.SocksPorts - 1)
+		}
+	}
+
+	if available := candidateCount(); needed > available {
+		return fmt.Errorf("%d ports are needed to run every proxy but only %d are available; widen the port range or reduce the number of proxies", needed, available)
+	}
+
+	return nil
+}
+
+// ParsePortList parses a comma-separated list of ports, such as "30001,30002,30003".
+func ParsePortList(list string) (out []int, err error) {
+	seen := make(map[int]bool)
+
+	for _, field := range strings.Split(list, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+
+		p, err := strconv.Atoi(field)
+		if err != nil || p <= 0 || p > 65535 {
+			return nil, fmt.Errorf("invalid port %q", field)
+		}
+
+		if seen[p] {
+			return nil, fmt.Errorf("port %d listed more than once", p)
+		}
+
+		seen[p] = true
+		out = append(out, p)
+	}
+
+	return out, nil
+}
+
+// portListening reports whether something is accepting TCP connections on port on the IPv4 loopback.
+func portListening(port int) bool {
+	conn, err := net.DialTimeout("tcp4", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), STARTUP_POLL)
+	if err != nil {
+		return false
+	}
+
+	conn.Close()
+	return true
+}
+
+// socketListening reports whether something is accepting connections on the Unix socket at path.
+func socketListening(path string) bool {
+	conn, err := net.DialTimeout("unix", path, STARTUP_POLL)
+	if err != nil {
+		return false
+	}
+
+	conn.Close()
+	return true
+}
+
+// portAvailable reports whether port can currently be bound on host using the given network ("tcp4" or "tcp6").
+func portAvailable(network, host string, port int) bool {
+	l, err := net.Listen(network, net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return false
+	}
+
+	l.Close()
+	return true
+}
+
+// mapPorts records the ports used by a Tor+Privoxy pair. tor is 0 when Tor listens on a Unix socket, and privoxy is 0
+// for a Tor instance behind a pool's shared Privoxy.
+func mapPorts(tor, privoxy int) {
+	careful.Lock()
+	defer careful.Unlock()
+
+	if tor > 0 {
+		ports[tor] = privoxy
+	}
+	if privoxy > 0 {
+		ports[privoxy] = tor
+	}
+}
+
+func unmapPorts(tor, privoxy int) {
+	releasePorts(tor, privoxy)
+}
+
+// releasePorts returns ports handed out by portPlz so they may be handed out again. Zeros are ignored.
+func releasePorts(list ...int) {
+	careful.Lock()
+	defer careful.Unlock()
+
+	for _, p := range list {
+		delete(ports, p)
+	}
+}
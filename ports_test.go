@@ -0,0 +1,90 @@
+package torotator
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+// resetPorts starts the port allocator afresh on the range [start, end).
+func resetPorts(t *testing.T, start, end int) {
+	t.Helper()
+
+	c := testConfig(t)
+	c.PortRangeStart, c.PortRangeEnd = start, end
+
+	careful.Lock()
+	defer careful.Unlock()
+
+	ports = make(map[int]int)
+	nextPort, pinnedPorts, nextPinned = 0, nil, 0
+}
+
+func TestPortPlzUnique(t *testing.T) {
+	const start, end, workers = 47310, 47326, 64
+	resetPorts(t, start, end)
+
+	var (
+		wg  sync.WaitGroup
+		mu  sync.Mutex
+		got = make(map[int]int)
+	)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			p, err := portPlz()
+			if err != nil {
+				if !errors.Is(err, ErrNoFreePort) {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+
+			mu.Lock()
+			got[p]++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	for p, n := range got {
+		if n > 1 {
+			t.Errorf("port %d handed out %d times", p, n)
+		}
+		if p < start || p >= end {
+			t.Errorf("port %d is outside %d-%d", p, start, end)
+		}
+	}
+
+	if len(got) != end-start {
+		t.Fatalf("got %d ports; want every one of the %d in the range", len(got), end-start)
+	}
+
+	if _, err := portPlz(); !errors.Is(err, ErrNoFreePort) {
+		t.Fatalf("expected ErrNoFreePort with every port handed out, got %v", err)
+	}
+
+	// a released port may be handed out again
+	releasePorts(start)
+	if p, err := portPlz(); err != nil || p != start {
+		t.Fatalf("got port %d, %v; want %d", p, err, start)
+	}
+}
+
+func TestParsePortList(t *testing.T) {
+	for list, ok := range map[string]bool{
+		"30001,30002": true,
+		"65535":       true,
+		"65536":       false,
+		"0":           false,
+		"1,1":         false,
+		"http":        false,
+	} {
+		if _, err := ParsePortList(list); (err == nil) != ok {
+			t.Errorf("ParsePortList(%q): %v", list, err)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package torotator
+
+import (
+	"context"
+	"net"
+	"net/http"
+	_ "net/http/pprof"
+	"strconv"
+
+	"github.com/uber-go/zap"
+)
+
+// ServePprof serves Go's profiling endpoints under /debug/pprof/ on the loopback interface. Profiles reveal a lot about
+// the process, so they are never exposed beyond the local host.
+func ServePprof(port int) {
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	l, err := Listen(context.Background(), addr)
+	if err != nil {
+		log.Error("unable to serve pprof", zap.String("address", addr), zap.Error(err))
+		return
+	}
+
+	log.Info("serving pprof", zap.String("address", addr))
+	if err := http.Serve(l, nil); err != nil {
+		log.Error("pprof server stopped", zap.Error(err))
+	}
+}
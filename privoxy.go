@@ -0,0 +1,311 @@
+package torotator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/uber-go/zap"
+)
+
+const PRIVOXY_TPL = `
+user-manual /usr/share/doc/privoxy/user-manual/
+confdir /etc/privoxy
+logdir {{.Dir}}
+actionsfile match-all.action # Actions that are applied to all sites and maybe overruled later on.
+actionsfile default.action   # Main actions file
+actionsfile user.action      # User customizations
+actionsfile {{.ActionsFile}}
+filterfile default.filter
+filterfile user.filter      # User customizations
+logfile logfile
+listen-address  127.0.0.1:{{.Port}}
+{{ if .Forward }}forward-socks5t / {{.Forward}} .{{ else if .Upstream }}forward / {{.Upstream}}  # direct, bypasses Tor{{ else }}# direct, bypasses Tor{{ end }}
+toggle  1
+enable-remote-toggle  0
+enable-remote-http-toggle  0
+enable-edit-actions 0
+enforce-blocks 0
+buffer-limit {{.BufferLimit}}
+enable-proxy-authentication-forwarding 0
+forwarded-connect-retries  0
+accept-intercepted-requests 1
+allow-cgi-request-crunching 0
+split-large-forms 0
+keep-alive-timeout {{ s .KeepAliveTimeout }}
+tolerate-pipelining 1
+socket-timeout {{ s .SocketTimeout }}
+`
+
+// privoxyTemplate is PRIVOXY_TPL, ready to render.
+var privoxyTemplate = template.Must(template.New("privoxy").Funcs(template.FuncMap{
+	// Privoxy only understands whole seconds
+	"s": func(d time.Duration) int64 {
+		return int64(d / time.Second)
+	},
+}).Parse(PRIVOXY_TPL))
+
+// PRIVOXY_NOWHERE is where a Privoxy waiting for its Tor instance forwards requests. Nothing listens on port 1, so any
+// request that reaches it early fails rather than leaving from this host's own IP.
+const PRIVOXY_NOWHERE = "127.0.0.1:1"
+
+// ANONYMOUS_USER_AGENT is sent in place of the client's User-Agent when anonymizing headers. It matches Tor Browser so
+// requests blend in with other Tor users.
+const ANONYMOUS_USER_AGENT = "Mozilla/5.0 (Windows NT 10.0; rv:128.0) Gecko/20100101 Firefox/128.0"
+
+type Privoxy struct {
+	log     zap.Logger
+	tor     *Tor
+	cmd     *Cmd
+	port    int
+	dir     string
+	pid     string
+	conf    string
+	actions string
+
+	// proxy identifies the proxy this Privoxy serves across the logs of every service involved
+	proxy int64
+
+	// pending is set while Privoxy waits for a Tor instance that is still starting
+	pending bool
+
+	// values rendered into the config
+	Dir              string
+	ActionsFile      string
+	Port             int
+	Forward          string
+	Upstream         string
+	BufferLimit      int
+	KeepAliveTimeout time.Duration
+	SocketTimeout    time.Duration
+}
+
+// NewPrivoxy starts a new Privoxy instance that forwards to tor. When tor is nil, requests go directly to the internet.
+func NewPrivoxy(ctx context.Context, proxy int64, tor *Tor) (p *Privoxy, err error) {
+	return startPrivoxy(ctx, &Privoxy{tor: tor, proxy: proxy})
+}
+
+// NewPendingPrivoxy starts a new Privoxy instance for a Tor instance that is still starting. Requests fail until Attach
+// points it at Tor, and it takes on Tor's proxy ID then.
+func NewPendingPrivoxy(ctx context.Context) (p *Privoxy, err error) {
+	return startPrivoxy(ctx, &Privoxy{pending: true})
+}
+
+// startPrivoxy starts Privoxy for p, trying new ports until one works.
+func startPrivoxy(ctx context.Context, p *Privoxy) (_ *Privoxy, err error) {
+	// loop until we find a port we like
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ErrTerminating
+		default:
+		}
+
+		var port int
+		if port, err = portPlz(); err != nil {
+			return nil, err
+		}
+
+		p.Configure(port)
+
+		if err = p.WriteConfig(); err != nil {
+			p.log.Error("failed to write config", zap.Error(err))
+			p.Close()
+			continue
+		}
+
+		p.cmd, err = StartCommand(ctx, p.log, p.Listening, cfg.PrivoxyBin,
+			"--no-daemon",
+			"--pidfile", p.pid,
+			p.conf)
+		if err != nil {
+			p.log.Error("failed to setup command", zap.Error(err))
+			p.Close()
+			time.Sleep(500 * time.Millisecond)
+			continue
+		}
+
+		p.cmd.transformLog = p.PrivoxyLogger
+
+		break
+	}
+
+	return p, nil
+}
+
+// Restart replaces the Privoxy process with a new one on the same port and config, so that HAProxy keeps its backend.
+// The new process's output is already being processed, so the caller must not call Wait.
+func (p *Privoxy) Restart(ctx context.Context) (err error) {
+	p.log.Info("restarting")
+	if err = p.cmd.Close(); err != nil && !errors.Is(err, ErrProcessKilled) {
+		p.log.Warn("failed to stop previous process", zap.Error(err))
+	}
+
+	p.cmd, err = StartCommand(ctx, p.log, p.Listening, cfg.PrivoxyBin,
+		"--no-daemon",
+		"--pidfile", p.pid,
+		p.conf)
+	if err != nil {
+		return err
+	}
+
+	p.cmd.transformLog = p.PrivoxyLogger
+	go p.Wait()
+
+	return nil
+}
+
+// Configure assigns the listening port for this instance, along with everything derived from it.
+func (p *Privoxy) Configure(port int) {
+	p.port = port
+	if p.tor != nil {
+		p.log = log.With(zap.String("service", "privoxy"),
+			zap.Int64("proxy", p.proxy),
+			zap.Int("port", p.port),
+			zap.Int("tor", p.tor.port))
+	} else if p.pending {
+		p.log = log.With(zap.String("service", "privoxy"),
+			zap.Int("port", p.port),
+			zap.Bool("pending", true))
+	} else {
+		p.log = log.With(zap.String("service", "privoxy"),
+			zap.Int64("proxy", p.proxy),
+			zap.Int("port", p.port),
+			zap.Bool("direct", true))
+	}
+
+	p.dir = path.Join(runDir, fmt.Sprintf("privoxy-%d", p.port))
+	p.pid = path.Join(p.dir, "privoxy.pid")
+	p.conf = path.Join(p.dir, "privoxy.conf")
+	p.actions = path.Join(p.dir, "torotator.action")
+
+	p.Dir = p.dir
+	p.ActionsFile = p.actions
+	p.Port = p.port
+	if p.tor != nil {
+		p.Forward = p.tor.SocksAddress()
+	} else if p.pending {
+		p.Forward = PRIVOXY_NOWHERE
+	}
+	p.Upstream = cfg.UpstreamProxy
+	p.BufferLimit = cfg.PrivoxyBufferLimit
+	p.KeepAliveTimeout = cfg.PrivoxyKeepAlive
+	p.SocketTimeout = cfg.PrivoxySocketTimeout
+}
+
+// Attach points Privoxy at tor, rewriting its config. Privoxy notices the change on its next request, so it doesn't need
+// to be restarted.
+func (p *Privoxy) Attach(tor *Tor) error {
+	p.tor, p.pending = tor, false
+	p.Configure(p.port)
+
+	return p.WriteConfig()
+}
+
+// Render writes the Privoxy configuration for this instance to w.
+func (p *Privoxy) Render(w io.Writer) error {
+	return privoxyTemplate.Execute(w, p)
+}
+
+// Actions returns the torotator-specific Privoxy actions applied to every request.
+func (p *Privoxy) Actions() string {
+	var actions []string
+
+	if cfg.ForwardedFor == "strip" {
+		actions = append(actions, "+hide-forwarded-for-headers")
+	}
+
+	if cfg.Anonymize {
+		actions = append(actions,
+			"+hide-from-header{block}",
+			"+hide-referrer{conditional-block}",
+			"+hide-accept-language{en-US,en;q=0.5}",
+			"+hide-user-agent{"+ANONYMOUS_USER_AGENT+"}")
+	}
+
+	if len(actions) == 0 {
+		return ""
+	}
+
+	// a lone slash matches every URL
+	return fmt.Sprintf("{ %s }\n/\n", strings.Join(actions, " \\\n  "))
+}
+
+func (p *Privoxy) WriteConfig() (err error) {
+	if err = os.MkdirAll(p.dir, 0755); err != nil {
+		return
+	}
+
+	var f *os.File
+	if f, err = os.OpenFile(p.conf, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644); err != nil {
+		return
+	}
+	defer f.Close()
+
+	if err = p.Render(f); err != nil {
+		return
+	}
+
+	return os.WriteFile(p.actions, []byte(p.Actions()), 0644)
+}
+
+// Listening reports whether Privoxy has opened its listening port.
+func (p *Privoxy) Listening() bool {
+	return portListening(p.port)
+}
+
+func (p *Privoxy) PrivoxyLogger(line string) (level, msg string, fields []zap.Field) {
+	line = line[37:]
+
+	lvlPos := strings.Index(line, ":")
+	level = strings.ToLower(line[:lvlPos])
+	if strings.Contains(level, " ") {
+		level = strings.Split(level, " ")[0]
+	}
+
+	msg = line[lvlPos+2:]
+
+	return
+}
+
+func (p *Privoxy) Done() <-chan struct{} {
+	return p.cmd.Done()
+}
+
+func (p *Privoxy) Wait() {
+	p.cmd.Wait()
+}
+
+func (p *Privoxy) Close() (err error) {
+	if p == nil || p.dir == "" {
+		return nil
+	}
+
+	defer func() {
+		if err = RemoveData(p.log, "privoxy", p.dir); err != nil {
+			p.log.Error("failed to data directory", zap.String("path", p.dir), zap.Error(err))
+		}
+		releasePorts(p.port)
+	}()
+
+	// never got as far as starting
+	if p.cmd == nil {
+		return nil
+	}
+
+	p.cmd.log.Info("cleaning up")
+	if err = p.cmd.Close(); err != nil {
+		if !errors.Is(err, ErrProcessKilled) {
+			p.cmd.log.Error("failed to kill server", zap.Error(err))
+		}
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,153 @@
+package torotator
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/uber-go/zap"
+)
+
+// killGroup sends SIGKILL to the entire process group led by pid. Children are started with Setpgid, so this also
+// takes care of anything they may have forked.
+func killGroup(pid int) error {
+	return syscall.Kill(-pid, syscall.SIGKILL)
+}
+
+// ReapOrphans looks for pid files left behind under dir by a previous run that did not exit cleanly. Any process that
+// is still running and still appears to belong to that run is killed along with its process group, and the stale
+// service directories are removed.
+func ReapOrphans(dir string) {
+	filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !strings.HasSuffix(name, ".pid") {
+			return nil
+		}
+
+		raw, err := os.ReadFile(name)
+		if err != nil {
+			return nil
+		}
+
+		pid, err := strconv.Atoi(strings.TrimSpace(string(raw)))
+		if err != nil || pid <= 0 {
+			return nil
+		}
+
+		svcDir := filepath.Dir(name)
+		_log := log.With(zap.Int("pid", pid), zap.String("path", svcDir))
+
+		// make sure the pid hasn't been recycled by something unrelated before killing it
+		if !ownsProcess(pid, svcDir) {
+			_log.Debug("ignoring stale pid file")
+			return nil
+		}
+
+		_log.Warn("reaping orphaned process")
+		if err = killGroup(pid); err != nil {
+			_log.Error("failed to reap orphaned process", zap.Error(err))
+		}
+
+		return nil
+	})
+
+	// only remove what we would have created ourselves, in case dir is shared with something else. Upgrades leave
+	// behind directories of every service, so they're kept along with any of them.
+	for _, d := range []struct{ service, pattern string }{
+		{"haproxy", "haproxy*"},
+		{"tor", "tor-*"},
+		{"privoxy", "privoxy-*"},
+		{"", "upgrade-*"},
+		{"", "ready"},
+	} {
+		if cfg.KeepData.Keeps(d.service) {
+			log.Info("keeping data from previous run", zap.String("path", filepath.Join(dir, d.pattern)))
+			continue
+		}
+
+		stale, _ := filepath.Glob(filepath.Join(dir, d.pattern))
+		for _, name := range stale {
+			if err := os.RemoveAll(name); err != nil {
+				log.Error("failed to remove stale data directory", zap.String("path", name), zap.Error(err))
+			}
+		}
+	}
+}
+
+// RemoveData removes the data directory of service, unless -keep-data covers it in which case the directory is left in
+// place for inspection.
+func RemoveData(l zap.Logger, service, dir string) error {
+	if cfg.KeepData.Keeps(service) {
+		l.Info("keeping data directory", zap.String("path", dir))
+		return nil
+	}
+
+	return os.RemoveAll(dir)
+}
+
+// KeepData is the -keep-data flag. On its own it keeps the data directory of every service, while a comma-separated
+// list of services keeps only theirs.
+type KeepData map[string]bool
+
+// KEEP_SERVICES lists the services -keep-data accepts.
+var KEEP_SERVICES = []string{"haproxy", "privoxy", "tor"}
+
+func (k KeepData) String() string {
+	var services []string
+	for _, service := range KEEP_SERVICES {
+		if k[service] {
+			services = append(services, service)
+		}
+	}
+
+	return strings.Join(services, ",")
+}
+
+func (k KeepData) Set(value string) error {
+	for service := range k {
+		delete(k, service)
+	}
+
+	switch value {
+	case "true":
+		for _, service := range KEEP_SERVICES {
+			k[service] = true
+		}
+		return nil
+	case "false", "":
+		return nil
+	}
+
+	for _, service := range strings.Split(value, ",") {
+		service = strings.TrimSpace(service)
+
+		known := false
+		for _, s := range KEEP_SERVICES {
+			known = known || s == service
+		}
+		if !known {
+			return fmt.Errorf("unknown service %q; expected %s", service, strings.Join(KEEP_SERVICES, ", "))
+		}
+
+		k[service] = true
+	}
+
+	return nil
+}
+
+// IsBoolFlag lets -keep-data be given without a value.
+func (k KeepData) IsBoolFlag() bool {
+	return true
+}
+
+// Keeps reports whether the data directory of service is kept. An empty service stands for directories shared by
+// every service, which are kept if any service's are.
+func (k KeepData) Keeps(service string) bool {
+	if service == "" {
+		return len(k) > 0
+	}
+
+	return k[service]
+}
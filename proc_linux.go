@@ -0,0 +1,90 @@
+package torotator
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// LIMITS_SUPPORTED tells whether -max-open-files, -max-memory and -cgroup can be applied on this platform.
+const LIMITS_SUPPORTED = true
+
+// childProcAttr places the child in its own process group and arranges for it to be killed if torotator dies without
+// getting a chance to clean up (SIGKILL, panic, log.Fatal).
+func childProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{
+		Setpgid:   true,
+		Pdeathsig: syscall.SIGKILL,
+	}
+}
+
+// processExited reports whether pid has terminated, including when it is a zombie that hasn't been reaped yet.
+func processExited(pid int) bool {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return true
+	}
+
+	// the state follows the parenthesized command name, which may itself contain spaces or parentheses
+	i := bytes.LastIndexByte(stat, ')')
+	if i < 0 || i+2 >= len(stat) {
+		return false
+	}
+
+	switch stat[i+2] {
+	case 'Z', 'X':
+		return true
+	}
+
+	return false
+}
+
+// ownsProcess reports whether the running process identified by pid was started with a command line referencing dir.
+func ownsProcess(pid int, dir string) bool {
+	cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return false
+	}
+
+	return bytes.Contains(cmdline, []byte(dir))
+}
+
+// limitProcess applies -max-open-files and -max-memory to the running process identified by pid and moves it into
+// -cgroup, if any of them are set.
+func limitProcess(pid int) error {
+	if cfg.MaxOpenFiles > 0 {
+		if err := prlimit(pid, syscall.RLIMIT_NOFILE, uint64(cfg.MaxOpenFiles)); err != nil {
+			return fmt.Errorf("unable to limit open files: %v", err)
+		}
+	}
+
+	if cfg.MaxMemory > 0 {
+		if err := prlimit(pid, syscall.RLIMIT_AS, uint64(cfg.MaxMemory)<<20); err != nil {
+			return fmt.Errorf("unable to limit memory: %v", err)
+		}
+	}
+
+	if cfg.Cgroup != "" {
+		if err := os.WriteFile(path.Join(cfg.Cgroup, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644); err != nil {
+			return fmt.Errorf("unable to move process into cgroup: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// prlimit sets both the soft and hard limit on resource for pid, so that the process can't raise it again.
+func prlimit(pid, resource int, max uint64) error {
+	lim := syscall.Rlimit{Cur: max, Max: max}
+	_, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid), uintptr(resource),
+		uintptr(unsafe.Pointer(&lim)), 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
@@ -0,0 +1,37 @@
+//go:build !linux
+// +build !linux
+
+package torotator
+
+import (
+	"syscall"
+)
+
+// LIMITS_SUPPORTED tells whether -max-open-files, -max-memory and -cgroup can be applied on this platform. Another
+// process' limits can only be changed on Linux.
+const LIMITS_SUPPORTED = false
+
+// childProcAttr places the child in its own process group. Pdeathsig is only available on Linux, so elsewhere we rely
+// on ReapOrphans to clean up after a crash.
+func childProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{
+		Setpgid: true,
+	}
+}
+
+// processExited reports whether pid has terminated. Without /proc, zombies can't be told apart from running processes,
+// so only processes that have already been reaped are detected.
+func processExited(pid int) bool {
+	return syscall.Kill(pid, 0) != nil
+}
+
+// ownsProcess has no portable way to inspect another process' command line, so a stale pid file is never trusted
+// outside of Linux.
+func ownsProcess(pid int, dir string) bool {
+	return false
+}
+
+// limitProcess does nothing, as Config.Validate rejects every limit where they aren't supported.
+func limitProcess(pid int) error {
+	return nil
+}
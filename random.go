@@ -0,0 +1,67 @@
+package torotator
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/uber-go/zap"
+)
+
+var (
+	// rng is the single source of randomness for everything torotator decides at random, so that a run can be
+	// reproduced by reusing its seed.
+	rng   *rand.Rand
+	rngMu sync.Mutex
+)
+
+// SeedRandom (re)initializes the shared source of randomness. A seed of 0 picks one based on the current time. The
+// seed in use is logged so a run can be repeated with -seed.
+func SeedRandom(seed int64) {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	rngMu.Lock()
+	rng = rand.New(rand.NewSource(seed))
+	rngMu.Unlock()
+
+	log.Info("seeded random number generator", zap.Int64("seed", seed))
+}
+
+// randInt63n returns a random number in [0, n) from the shared source.
+func randInt63n(n int64) int64 {
+	rngMu.Lock()
+	defer rngMu.Unlock()
+
+	return rng.Int63n(n)
+}
+
+// ProxiesExpire reports whether proxies are replaced once their lifetime is up. In -once mode they are only replaced if
+// they fail, and with the manual rotation strategy only when asked to.
+func ProxiesExpire() bool {
+	return !cfg.Once && cfg.RotationStrategy != "manual"
+}
+
+// StaggerDelay returns how long to wait before starting the next proxy while a pool first fills: somewhere between half
+// and one and a half times -startup-stagger, so that Tor instances don't bootstrap in lockstep.
+func StaggerDelay() time.Duration {
+	half := int64(cfg.StartupStagger / 2)
+	return time.Duration(half + randInt63n(2*half+1))
+}
+
+// ProxyLifetime returns how long a new proxy should stay in rotation: the maximum proxy time, adjusted by a random
+// amount of up to -jitter in either direction so that proxies started together don't all expire together.
+func ProxyLifetime() time.Duration {
+	lifetime := time.Duration(cfg.MaxProxyTime) * time.Second
+	if cfg.LifetimeJitter > 0 {
+		jitter := int64(cfg.LifetimeJitter) * int64(time.Second)
+		lifetime += time.Duration(randInt63n(2*jitter+1) - jitter)
+	}
+
+	if lifetime < time.Second {
+		lifetime = time.Second
+	}
+
+	return lifetime
+}
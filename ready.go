@@ -0,0 +1,76 @@
+package torotator
+
+import (
+	"os"
+	"path"
+	"sync"
+
+	"github.com/uber-go/zap"
+)
+
+var (
+	ready      bool
+	readyPools = make(map[*HAProxy]bool)
+	readyMu    sync.Mutex
+)
+
+// ReadyFile returns the path of the file that exists only while the proxy is able to serve requests.
+func ReadyFile() string {
+	return path.Join(cfg.DataDir, "ready")
+}
+
+// IsReady reports whether every pool is currently usable.
+func IsReady() bool {
+	readyMu.Lock()
+	defer readyMu.Unlock()
+
+	return ready
+}
+
+// IsPoolReady reports whether the pool served by h is currently usable.
+func IsPoolReady(h *HAProxy) bool {
+	readyMu.Lock()
+	defer readyMu.Unlock()
+
+	return readyPools[h]
+}
+
+// SetReady records whether the pool served by h is currently usable. The ready file is created once every pool's
+// HAProxy has successfully loaded a configuration with at least one backend, and removed again whenever that stops
+// being true, so wrapper scripts and container health checks can simply test for its existence. Passing a nil h with
+// r false marks everything as unusable, such as during shutdown.
+func SetReady(h *HAProxy, r bool) {
+	readyMu.Lock()
+	defer readyMu.Unlock()
+
+	if h == nil {
+		readyPools = make(map[*HAProxy]bool)
+	} else {
+		readyPools[h] = r
+	}
+
+	all := h != nil && len(readyPools) == len(pools)
+	for _, r := range readyPools {
+		all = all && r
+	}
+
+	if all == ready {
+		return
+	}
+
+	ready = all
+	name := ReadyFile()
+
+	if !ready {
+		log.Info("proxy not ready", zap.String("path", name))
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			log.Error("failed to remove ready file", zap.String("path", name), zap.Error(err))
+		}
+		return
+	}
+
+	log.Info("proxy ready", zap.String("path", name))
+	if err := os.WriteFile(name, nil, 0644); err != nil {
+		log.Error("failed to write ready file", zap.String("path", name), zap.Error(err))
+	}
+}
@@ -0,0 +1,94 @@
+package torotator
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/uber-go/zap"
+)
+
+// Reasons a proxy was recycled, as reported in logs, events and the status file.
+const (
+	RECYCLE_SHUTDOWN       = "shutdown"
+	RECYCLE_TOR_EXITED     = "tor_exited"
+	RECYCLE_TOR_STUCK      = "bootstrap_timeout"
+	RECYCLE_PRIVOXY_EXITED = "privoxy_exited"
+	RECYCLE_EXPIRED        = "expired"
+	RECYCLE_REQUESTED      = "requested"
+	RECYCLE_UNHEALTHY      = "unhealthy"
+	RECYCLE_NOT_LIVE       = "never_live"
+	RECYCLE_SCALED_DOWN    = "scaled_down"
+)
+
+// Recycler keeps track of every running proxy so they can be told to recycle on demand. Each proxy is known by its
+// Privoxy port.
+type Recycler struct {
+	mu      sync.Mutex
+	proxies map[chan struct{}]int
+}
+
+// recycler tracks the proxies of every pool.
+var recycler = &Recycler{proxies: make(map[chan struct{}]int)}
+
+// Register adds the proxy whose Privoxy listens on port, returning a channel that is closed when the proxy should
+// recycle itself.
+func (r *Recycler) Register(port int) chan struct{} {
+	c := make(chan struct{})
+
+	r.mu.Lock()
+	r.proxies[c] = port
+	r.mu.Unlock()
+
+	return c
+}
+
+// Recycle tells the proxy whose Privoxy listens on port to recycle, reporting whether there was such a proxy.
+func (r *Recycler) Recycle(port int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for c, p := range r.proxies {
+		if p == port {
+			delete(r.proxies, c)
+			close(c)
+			return true
+		}
+	}
+
+	return false
+}
+
+// Unregister forgets about a proxy that has terminated.
+func (r *Recycler) Unregister(c chan struct{}) {
+	r.mu.Lock()
+	delete(r.proxies, c)
+	r.mu.Unlock()
+}
+
+// RecycleAll tells every proxy running at the time of the call to recycle, one at a time with stagger in between so
+// the pool is never emptied all at once.
+func (r *Recycler) RecycleAll(ctx context.Context, stagger time.Duration) {
+	r.mu.Lock()
+	var pending []chan struct{}
+	for c := range r.proxies {
+		pending = append(pending, c)
+	}
+	r.mu.Unlock()
+
+	log.Info("recycling all proxies", zap.Int("count", len(pending)), zap.Duration("stagger", stagger))
+
+	for i, c := range pending {
+		if i > 0 && Sleep(ctx, stagger) != nil {
+			return
+		}
+
+		r.mu.Lock()
+		if _, ok := r.proxies[c]; ok {
+			// proxies that already went away on their own are skipped
+			delete(r.proxies, c)
+			close(c)
+		}
+		r.mu.Unlock()
+	}
+}
@@ -0,0 +1,204 @@
+package torotator
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/uber-go/zap"
+)
+
+// RETIRE_POLL is how often a shrinking pool looks again for proxies to retire when every remaining one is still
+// starting up.
+const RETIRE_POLL = time.Second
+
+// Slots limits how many proxies a pool runs at once. Unlike a buffered channel, the limit can change while proxies
+// hold slots, which is how a pool is scaled at runtime.
+type Slots struct {
+	mu   sync.Mutex
+	size int
+	used int
+
+	// freed is closed, and replaced, whenever a slot may have become available
+	freed chan struct{}
+}
+
+// NewSlots returns a limit of size proxies.
+func NewSlots(size int) *Slots {
+	return &Slots{size: size, freed: make(chan struct{})}
+}
+
+// Acquire waits for a free slot, returning an error only if ctx is canceled first.
+func (s *Slots) Acquire(ctx context.Context) error {
+	for {
+		s.mu.Lock()
+		if s.used < s.size {
+			s.used++
+			s.mu.Unlock()
+			return nil
+		}
+		freed := s.freed
+		s.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-freed:
+		}
+	}
+}
+
+// Release gives back a slot taken with Acquire.
+func (s *Slots) Release() {
+	s.mu.Lock()
+	s.used--
+	s.wake()
+	s.mu.Unlock()
+}
+
+// Resize changes the limit, returning the previous one. Proxies beyond a smaller limit keep their slots until they are
+// released.
+func (s *Slots) Resize(size int) (prev int) {
+	s.mu.Lock()
+	prev, s.size = s.size, size
+	s.wake()
+	s.mu.Unlock()
+
+	return prev
+}
+
+// Size returns the current limit.
+func (s *Slots) Size() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.size
+}
+
+// Excess returns how many slots are held beyond the limit.
+func (s *Slots) Excess() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.used - s.size
+}
+
+// wake lets everyone waiting in Acquire check for a free slot again. s.mu must be held.
+func (s *Slots) wake() {
+	close(s.freed)
+	s.freed = make(chan struct{})
+}
+
+// Size returns the number of proxies the pool currently aims to keep running.
+func (h *HAProxy) Size() int {
+	return h.slots.Size()
+}
+
+// Scale changes the number of proxies the pool keeps running, returning the previous number. Growing the pool starts
+// new proxies right away, while shrinking it drains the oldest proxies beyond the new size and retires them without
+// replacement. Either way, each proxy's share of the connection limit is worked out again for the new size, and
+// HAProxy is reloaded with it before Scale returns.
+func (h *HAProxy) Scale(ctx context.Context, size int) (prev int) {
+	prev = h.slots.Resize(size)
+	h.log.Info("scaling pool", zap.Int("from", prev), zap.Int("to", size))
+
+	if size < prev {
+		go h.retireExcess(ctx)
+	}
+
+	h.Tune()
+	h.WriteConfig(ctx, true)
+	WriteStatus()
+
+	return prev
+}
+
+// retireExcess retires proxies until no more of them are running than the pool's size calls for. Proxies that are
+// still starting aren't in HAProxy yet, so they're waited for when nothing else is left to retire. Only one call runs
+// at a time for each pool, and it accounts for any resizing while it runs.
+func (h *HAProxy) retireExcess(ctx context.Context) {
+	h.mu.Lock()
+	if h.shrinking {
+		h.mu.Unlock()
+		return
+	}
+	h.shrinking = true
+	h.mu.Unlock()
+
+	defer func() {
+		h.mu.Lock()
+		h.shrinking = false
+		h.mu.Unlock()
+	}()
+
+	for {
+		h.mu.Lock()
+		excess := h.slots.Excess() - h.retiring
+		h.mu.Unlock()
+
+		if excess <= 0 {
+			return
+		}
+
+		port := h.markRetiring()
+		if port == 0 {
+			if Sleep(ctx, RETIRE_POLL) != nil {
+				return
+			}
+			continue
+		}
+
+		go func() {
+			if err := h.Drain(ctx, port); err != nil {
+				h.log.Warn("failed to drain backend", zap.Int("backend", port), zap.Error(err))
+			}
+
+			recycler.Recycle(port)
+		}()
+	}
+}
+
+// markRetiring picks the oldest backend that isn't already on its way out and marks it as retiring, returning its port,
+// or 0 if there is no such backend.
+func (h *HAProxy) markRetiring() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var ports []int
+	for port, be := range h.Backends {
+		if !be.Draining && !be.Retiring {
+			ports = append(ports, port)
+		}
+	}
+
+	if len(ports) == 0 {
+		return 0
+	}
+
+	sort.Slice(ports, func(i, j int) bool {
+		return h.Backends[ports[i]].Added.Before(h.Backends[ports[j]].Added)
+	})
+
+	port := ports[0]
+	h.Backends[port].Retiring = true
+	h.retiring++
+
+	return port
+}
+
+// Retiring reports whether the backend on port is being retired because the pool shrank.
+func (h *HAProxy) Retiring(port int) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	be, ok := h.Backends[port]
+	return ok && be.Retiring
+}
+
+// Retired accounts for a retiring proxy that has given up its slot.
+func (h *HAProxy) Retired() {
+	h.mu.Lock()
+	h.retiring--
+	h.mu.Unlock()
+}
@@ -0,0 +1,51 @@
+package torotator
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestScaleRetunesServerMaxConn(t *testing.T) {
+	h := testHAProxy(t, 18994, 4)
+	cfg.MaxConn = 100
+	h.Tune()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// a backend to render the limit for; the pool never fills, so HAProxy is never started
+	h.mu.Lock()
+	h.Backends[24000] = &Backend{Weight: FULL_WEIGHT}
+	h.mu.Unlock()
+
+	for _, size := range []int{5, 2} {
+		h.Scale(ctx, size)
+
+		want := cfg.MaxConn / size
+		h.mu.Lock()
+		got := h.ServerMaxConn
+		h.mu.Unlock()
+		if got != want {
+			t.Fatalf("scaled to %d: got server maxconn %d; want %d", size, got, want)
+		}
+
+		line := fmt.Sprintf("maxconn %d check", want)
+		if raw, err := os.ReadFile(h.conf); err != nil || !strings.Contains(string(raw), line) {
+			t.Fatalf("scaled to %d: config doesn't have %q (%v)", size, line, err)
+		}
+	}
+
+	// an explicit -server-maxconn isn't touched
+	cfg.ServerMaxConn = 7
+	h.Tune()
+	h.Scale(ctx, 3)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.ServerMaxConn != 7 {
+		t.Fatalf("got server maxconn %d; want the configured 7", h.ServerMaxConn)
+	}
+}
@@ -0,0 +1,162 @@
+package torotator
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// Spares keeps a small reserve of Tor instances that have already bootstrapped but aren't in rotation yet, so that an
+// expired proxy can be replaced without waiting for a fresh Tor to bootstrap.
+type Spares struct {
+	pool  *Pool
+	slots chan struct{}
+	ready chan *Tor
+
+	// with -socks-ports, current is the instance whose SocksPorts are being handed out, and next the index of the
+	// next one to hand out
+	mu      sync.Mutex
+	current *Tor
+	next    int
+	done    <-chan struct{}
+}
+
+// NewSpares starts maintaining up to n bootstrapped Tor instances for pool until ctx is canceled.
+func NewSpares(ctx context.Context, pool *Pool, n int) *Spares {
+	s := &Spares{
+		pool:  pool,
+		slots: make(chan struct{}, n),
+		ready: make(chan *Tor, n),
+		done:  ctx.Done(),
+	}
+
+	if n > 0 {
+		go s.fill(ctx)
+	}
+
+	if cfg.SocksPorts > 1 {
+		go func() {
+			<-ctx.Done()
+			s.mu.Lock()
+			s.letGo()
+			s.mu.Unlock()
+		}()
+	}
+
+	return s
+}
+
+// fill bootstraps a new spare whenever there is room in the reserve.
+func (s *Spares) fill(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			s.drain()
+			return
+		case s.slots <- struct{}{}:
+		}
+
+		tor, err := StartTor(ctx, s.pool.ExitCountries(), true)
+		exhaustion.Check(err)
+		if err != nil {
+			<-s.slots
+			exhaustion.Wait(ctx)
+			continue
+		}
+
+		tor.log.Info("warm spare ready")
+		s.ready <- tor
+	}
+}
+
+// drain cleans up any spares that were never used.
+func (s *Spares) drain() {
+	for {
+		select {
+		case tor := <-s.ready:
+			tor.Close()
+		default:
+			return
+		}
+	}
+}
+
+// Get returns a running Tor instance, preferring a bootstrapped spare and falling back to starting a fresh one. The
+// instance's output is already being processed, so the caller must not call Wait on it. With -socks-ports, each
+// instance is handed out once for each of its SocksPorts, as a view that stands for that port alone.
+func (s *Spares) Get(ctx context.Context) (*Tor, error) {
+	if cfg.SocksPorts <= 1 {
+		return s.get(ctx)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// nothing is handed out once shutdown has begun, as nothing would let go of it
+	select {
+	case <-s.done:
+		return nil, ErrTerminating
+	default:
+	}
+
+	// an instance that died has no more ports worth handing out
+	if s.current != nil {
+		select {
+		case <-s.current.Done():
+			s.letGo()
+		default:
+		}
+	}
+
+	if s.current == nil {
+		tor, err := s.get(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		atomic.StoreInt32(&tor.leases, 1)
+		s.current, s.next = tor, 0
+	}
+
+	v := s.current.View(s.next)
+	if s.next++; s.next == cfg.SocksPorts {
+		s.letGo()
+	}
+
+	return v, nil
+}
+
+// letGo stops handing out SocksPorts of the current instance, which closes once its views are done with it. The caller
+// must hold mu.
+func (s *Spares) letGo() {
+	if s.current != nil {
+		s.current.Release()
+		s.current = nil
+	}
+}
+
+// get returns a whole Tor instance, as described for Get.
+func (s *Spares) get(ctx context.Context) (*Tor, error) {
+	for {
+		select {
+		case tor := <-s.ready:
+			<-s.slots
+
+			// spares can die while they wait around
+			select {
+			case <-tor.Done():
+				tor.log.Warn("discarding dead spare")
+				tor.Close()
+				continue
+			default:
+			}
+
+			tor.log.Info("promoting warm spare")
+			return tor, nil
+
+		default:
+		}
+
+		return StartTor(ctx, s.pool.ExitCountries(), false)
+	}
+}
@@ -0,0 +1,230 @@
+package torotator
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/uber-go/zap"
+)
+
+// ServerStats holds the interesting parts of one row of HAProxy's "show stat" output.
+type ServerStats struct {
+	Proxy         string
+	Server        string
+	Status        string
+	Weight        int
+	Sessions      int64
+	TotalSessions int64
+	BytesIn       int64
+	BytesOut      int64
+}
+
+// Stats queries HAProxy's runtime API for the current statistics of every frontend, backend and server.
+func (h *HAProxy) Stats() (stats []ServerStats, err error) {
+	resp, err := h.Command("show stat")
+	if err != nil {
+		return nil, err
+	}
+
+	// the header line is prefixed with "# "
+	r := csv.NewReader(strings.NewReader(strings.TrimPrefix(resp, "# ")))
+	r.FieldsPerRecord = -1
+
+	rows, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("empty stats response")
+	}
+
+	col := make(map[string]int)
+	for i, name := range rows[0] {
+		col[name] = i
+	}
+
+	get := func(row []string, name string) string {
+		if i, ok := col[name]; ok && i < len(row) {
+			return row[i]
+		}
+		return ""
+	}
+
+	num := func(row []string, name string) int64 {
+		n, _ := strconv.ParseInt(get(row, name), 10, 64)
+		return n
+	}
+
+	for _, row := range rows[1:] {
+		stats = append(stats, ServerStats{
+			Proxy:         get(row, "pxname"),
+			Server:        get(row, "svname"),
+			Status:        get(row, "status"),
+			Weight:        int(num(row, "weight")),
+			Sessions:      num(row, "scur"),
+			TotalSessions: num(row, "stot"),
+			BytesIn:       num(row, "bin"),
+			BytesOut:      num(row, "bout"),
+		})
+	}
+
+	return stats, nil
+}
+
+// BackendStats returns the statistics for each Tor+Privoxy server, leaving out the frontend and backend totals.
+func (h *HAProxy) BackendStats() (out []ServerStats, err error) {
+	stats, err := h.Stats()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range stats {
+		if s.Proxy == "privoxies" && s.Server != "BACKEND" {
+			out = append(out, s)
+		}
+	}
+
+	return out, nil
+}
+
+// UpdateTraffic queries HAProxy for the statistics of each backend and adds the traffic seen since the last update to
+// each backend's running totals. HAProxy's counters start over whenever it reloads, so the totals are only as accurate
+// as updates are frequent.
+func (h *HAProxy) UpdateTraffic() (stats []ServerStats, err error) {
+	if stats, err = h.BackendStats(); err != nil {
+		return nil, err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, s := range stats {
+		port, err := strconv.Atoi(strings.TrimPrefix(s.Server, "privoxy-"))
+		if err != nil {
+			continue
+		}
+
+		be, ok := h.Backends[port]
+		if !ok {
+			continue
+		}
+
+		be.BytesIn += counterDelta(be.seenIn, s.BytesIn)
+		be.BytesOut += counterDelta(be.seenOut, s.BytesOut)
+		be.seenIn, be.seenOut = s.BytesIn, s.BytesOut
+	}
+
+	return stats, nil
+}
+
+// counterDelta returns how much a counter has grown from prev to cur. A counter that went backwards was reset, so all of
+// cur is new.
+func counterDelta(prev, cur int64) int64 {
+	if cur < prev {
+		return cur
+	}
+
+	return cur - prev
+}
+
+// Traffic returns the total bytes received from and sent to clients through the backend on port, as of the last
+// update.
+func (h *HAProxy) Traffic(port int) (in, out int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if be, ok := h.Backends[port]; ok {
+		return be.BytesIn, be.BytesOut
+	}
+
+	return 0, 0
+}
+
+// Latencies returns a copy of each backend's latency figures by server name, along with every sample across the pool.
+func (h *HAProxy) Latencies() (byServer map[string]*Latency, connect, firstByte []time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	byServer = make(map[string]*Latency)
+	for port, be := range h.Backends {
+		if len(be.Latency.connect) == 0 {
+			continue
+		}
+
+		l := &Latency{
+			connect:   append([]time.Duration{}, be.Latency.connect...),
+			firstByte: append([]time.Duration{}, be.Latency.firstByte...),
+		}
+		byServer[fmt.Sprintf("privoxy-%d", port)] = l
+
+		connect = append(connect, l.connect...)
+		firstByte = append(firstByte, l.firstByte...)
+	}
+
+	return byServer, connect, firstByte
+}
+
+// LogStats periodically logs the traffic statistics of every backend until ctx is canceled.
+func LogStats(ctx context.Context, h *HAProxy, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		// nothing worth asking HAProxy about
+		if len(h.BackendPorts()) == 0 {
+			continue
+		}
+
+		stats, err := h.UpdateTraffic()
+		if err != nil {
+			h.log.Warn("failed to query stats", zap.Error(err))
+			continue
+		}
+
+		latencies, connect, firstByte := h.Latencies()
+		for _, s := range stats {
+			fields := []zap.Field{
+				zap.String("backend", s.Server),
+				zap.String("status", s.Status),
+				zap.Int("weight", s.Weight),
+				zap.Int64("sessions", s.Sessions),
+				zap.Int64("total_sessions", s.TotalSessions),
+				zap.Int64("bytes_in", s.BytesIn),
+				zap.Int64("bytes_out", s.BytesOut),
+			}
+
+			if l := latencies[s.Server]; l != nil {
+				fields = append(fields,
+					zap.Duration("connect_p50", percentile(l.connect, 50)),
+					zap.Duration("connect_p90", percentile(l.connect, 90)),
+					zap.Duration("first_byte_p50", percentile(l.firstByte, 50)),
+					zap.Duration("first_byte_p90", percentile(l.firstByte, 90)))
+			}
+
+			h.log.Info("backend stats", fields...)
+		}
+
+		// how the pool as a whole is doing, to put each backend's figures in perspective
+		if len(connect) > 0 {
+			h.log.Info("pool latency",
+				zap.Int("samples", len(connect)),
+				zap.Duration("connect_p50", percentile(connect, 50)),
+				zap.Duration("connect_p90", percentile(connect, 90)),
+				zap.Duration("connect_p99", percentile(connect, 99)),
+				zap.Duration("first_byte_p50", percentile(firstByte, 50)),
+				zap.Duration("first_byte_p90", percentile(firstByte, 90)),
+				zap.Duration("first_byte_p99", percentile(firstByte, 99)))
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package torotator
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/uber-go/zap"
+)
+
+// STATUS_INTERVAL is how often the status file is refreshed when nothing else has changed.
+const STATUS_INTERVAL = 10 * time.Second
+
+// Status is a snapshot of every pool, as written to the status file.
+type Status struct {
+	Updated time.Time     `json:"updated"`
+	Ready   bool          `json:"ready"`
+	Ports   PortStats     `json:"ports"`
+	Pools   []*PoolStatus `json:"pools"`
+}
+
+// PoolStatus describes a single pool and its HAProxy instance within a Status.
+type PoolStatus struct {
+	Port       int              `json:"port"`
+	Countries  []string         `json:"countries,omitempty"`
+	Weights    []int            `json:"weights,omitempty"`
+	Size       int              `json:"size"`
+	Ready      bool             `json:"ready"`
+	LastReload time.Time        `json:"last_reload"`
+	Coalesced  int64            `json:"coalesced_reloads"`
+	Backends   []BackendStatus  `json:"backends"`
+	Recycled   []RecycledStatus `json:"recycled"`
+}
+
+// BackendStatus describes a single Tor+Privoxy pair within a PoolStatus.
+type BackendStatus struct {
+	Port      int            `json:"port"`
+	Proxy     int64          `json:"proxy"`
+	Age       float64        `json:"age"`
+	Weight    int            `json:"weight"`
+	WarmingUp bool           `json:"warming_up"`
+	Retiring  bool           `json:"retiring"`
+	Direct    bool           `json:"direct"`
+	BytesIn   int64          `json:"bytes_in"`
+	BytesOut  int64          `json:"bytes_out"`
+	Circuit   *Circuit       `json:"circuit,omitempty"`
+	Latency   *LatencyStatus `json:"latency,omitempty"`
+}
+
+// RecycledStatus describes a Tor+Privoxy pair that has been torn down, and why.
+type RecycledStatus struct {
+	Port   int       `json:"port"`
+	Proxy  int64     `json:"proxy"`
+	Reason string    `json:"reason"`
+	Age    float64   `json:"age"`
+	Time   time.Time `json:"time"`
+}
+
+// RECENT_RECYCLES is how many recycled proxies each pool remembers for the status file.
+const RECENT_RECYCLES = 20
+
+// statusMu keeps concurrent writes of the status file from sharing its temporary file.
+var statusMu sync.Mutex
+
+// StatusFile returns the path the status file is written to.
+func StatusFile() string {
+	if cfg.StatusFile != "" {
+		return cfg.StatusFile
+	}
+
+	return path.Join(cfg.DataDir, "status.json")
+}
+
+// CurrentStatus takes a snapshot of every pool.
+func CurrentStatus() *Status {
+	st := &Status{
+		Updated: time.Now().UTC(),
+		Ready:   IsReady(),
+		Ports:   CurrentPortStats(),
+		Pools:   []*PoolStatus{},
+	}
+
+	for _, h := range haproxies {
+		st.Pools = append(st.Pools, h.Status())
+	}
+
+	return st
+}
+
+// Status takes a snapshot of the current state of HAProxy and its backends.
+func (h *HAProxy) Status() *PoolStatus {
+	now := time.Now()
+	st := &PoolStatus{
+		Port:      h.Port,
+		Countries: h.pool.Countries,
+		Weights:   h.pool.Weights,
+		Size:      h.Size(),
+		Ready:     IsPoolReady(h),
+		Backends:  []BackendStatus{},
+	}
+
+	h.mu.Lock()
+	st.LastReload = h.lastReload.UTC()
+	st.Coalesced = atomic.LoadInt64(&h.coalesced)
+	st.Recycled = append([]RecycledStatus{}, h.recycled...)
+	for port, be := range h.Backends {
+		st.Backends = append(st.Backends, BackendStatus{
+			Port:      port,
+			Proxy:     be.Proxy,
+			Age:       now.Sub(be.Added).Seconds(),
+			Weight:    be.Weight,
+			WarmingUp: be.Weight < FULL_WEIGHT,
+			Retiring:  be.Retiring,
+			Direct:    be.Direct,
+			BytesIn:   be.BytesIn,
+			BytesOut:  be.BytesOut,
+			Circuit:   be.Circuit,
+			Latency:   be.Latency.Status(),
+		})
+	}
+	h.mu.Unlock()
+
+	sort.Slice(st.Backends, func(i, j int) bool {
+		return st.Backends[i].Port < st.Backends[j].Port
+	})
+
+	return st
+}
+
+// Recycled records that the backend on port, serving proxy, was torn down for reason after running for age, keeping only the most recent
+// few.
+func (h *HAProxy) Recycled(port int, proxy int64, reason string, age time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.recycled = append(h.recycled, RecycledStatus{
+		Port:   port,
+		Proxy:  proxy,
+		Reason: reason,
+		Age:    age.Seconds(),
+		Time:   time.Now().UTC(),
+	})
+
+	if n := len(h.recycled); n > RECENT_RECYCLES {
+		h.recycled = h.recycled[n-RECENT_RECYCLES:]
+	}
+}
+
+// WriteStatus persists a snapshot of every pool to the status file. The file is replaced atomically so readers never
+// see a partial snapshot.
+func WriteStatus() {
+	// the process taking over reports on its own pools
+	if HandingOff() {
+		return
+	}
+
+	statusMu.Lock()
+	defer statusMu.Unlock()
+
+	name := StatusFile()
+	tmp := name + ".tmp"
+
+	out, err := json.MarshalIndent(CurrentStatus(), "", "  ")
+	if err != nil {
+		log.Error("failed to encode status", zap.Error(err))
+		return
+	}
+
+	if err = os.WriteFile(tmp, out, 0644); err == nil {
+		err = os.Rename(tmp, name)
+	}
+
+	if err != nil {
+		log.Error("failed to write status file", zap.String("path", name), zap.Error(err))
+	}
+}
+
+// StatusLoop refreshes the status file periodically until ctx is canceled, at which point the file is removed so it
+// doesn't describe a pool that no longer exists.
+func StatusLoop(ctx context.Context) {
+	t := time.NewTicker(STATUS_INTERVAL)
+	defer t.Stop()
+
+	for {
+		// keep traffic totals current; a pool that can't be asked simply reports what it had
+		for _, h := range haproxies {
+			h.UpdateTraffic()
+		}
+
+		WriteStatus()
+
+		select {
+		case <-ctx.Done():
+			if !HandingOff() {
+				os.Remove(StatusFile())
+			}
+			return
+		case <-t.C:
+		}
+	}
+}
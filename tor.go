@@ -0,0 +1,623 @@
+package torotator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/uber-go/zap"
+)
+
+// bootstrapRE matches Tor's bootstrap progress messages, such as "Bootstrapped 45% (requesting_descriptors): Asking for
+// relay descriptors". Older versions of Tor omit the parenthesized phase tag.
+var bootstrapRE = regexp.MustCompile(`^Bootstrapped (\d+)%(?: \(([^)]+)\))?(?:: (.*))?`)
+
+// torLogRE splits a line of Tor's log into its level and message, such as "[notice] Bootstrapped 5%" in "Oct 03
+// 12:00:00.000 [notice] Bootstrapped 5%", whatever the timestamp looks like.
+var torLogRE = regexp.MustCompile(`\[(debug|info|notice|warn|err)\] (.*)$`)
+
+type Tor struct {
+	log       zap.Logger
+	cmd       *Cmd
+	port      int
+	dir       string
+	pid       string
+	countries []string
+
+	// proxy identifies the proxy this Tor serves across the logs of every service involved
+	proxy int64
+
+	// socket is the path of the Unix socket Tor accepts SOCKS connections on, when not using a TCP port
+	socket string
+
+	// control is the path of the Unix socket of Tor's control port, when it has one
+	control string
+
+	// bootstrap holds the most recently reported bootstrap percentage
+	bootstrap int32
+
+	// watchBootstrap is set when something waits for this instance to bootstrap, which needs Tor to report progress
+	watchBootstrap bool
+
+	// extraPorts holds the SocksPorts beyond port of an instance with several, see -socks-ports
+	extraPorts []int
+
+	// parent is the instance a view stands for one SocksPort of, see View
+	parent *Tor
+
+	// leases counts the references to an instance with several SocksPorts: one for each view still in use, and one
+	// while Spares may hand out more. The instance is closed along with the last reference.
+	leases int32
+}
+
+// NewTor starts a new Tor instance. If countries is not empty, only exit nodes in those countries will be used. When
+// watchBootstrap is set, Tor reports its bootstrap progress even if its log level would otherwise hide it.
+func NewTor(ctx context.Context, countries []string, watchBootstrap bool) (t *Tor, err error) {
+	t = &Tor{countries: countries, proxy: NextProxyID(), watchBootstrap: watchBootstrap || trackBootstrap()}
+	b := &Backoff{Min: 500 * time.Millisecond, Max: 30 * time.Second}
+
+	// loop until we find a port we like, backing off in case tor itself is the problem
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ErrTerminating
+		default:
+		}
+
+		var port int
+		if port, err = torPort(); err != nil {
+			return nil, err
+		}
+
+		t.Configure(port)
+
+		// each extra SocksPort goes to a proxy of its own, see View
+		t.extraPorts = nil
+		for len(t.extraPorts) < cfg.SocksPorts-1 {
+			if port, err = portPlz(); err != nil {
+				releasePorts(append(t.extraPorts, t.TCPPort())...)
+				return nil, err
+			}
+			t.extraPorts = append(t.extraPorts, port)
+		}
+		t.MakeDirs()
+		if torCache != nil {
+			torCache.Seed(t.log, t.dir)
+		}
+
+		t.cmd, err = StartCommand(ctx, t.log, t.Listening, cfg.TorBin, t.Args()...)
+		if err != nil {
+			// don't leave a data directory behind for every port we tried
+			t.Close()
+
+			delay := b.Next()
+			if b.Attempts() >= cfg.TorAttempts {
+				t.log.Error("giving up on starting tor", zap.Int("attempts", b.Attempts()), zap.Error(err))
+				return nil, fmt.Errorf("failed to start tor after %d attempts: %v", b.Attempts(), err)
+			}
+
+			t.log.Error("failed to setup command",
+				zap.Int("attempt", b.Attempts()),
+				zap.Duration("backoff", delay),
+				zap.Error(err))
+			if Sleep(ctx, delay) != nil {
+				return nil, ErrTerminating
+			}
+			continue
+		}
+
+		t.cmd.transformLog = t.TorLogger
+
+		break
+	}
+
+	return t, nil
+}
+
+// nodeRE matches the ways a relay may be named in EntryNodes: a fingerprint, optionally prefixed with $, a {cc} country
+// code, or a nickname.
+var nodeRE = regexp.MustCompile(`^(\$?[0-9A-Fa-f]{40}|\{[a-zA-Z]{2}\}|[a-zA-Z0-9]{1,19})$`)
+
+// guardNodes holds the parsed -entry-nodes list.
+var guardNodes []string
+
+// ParseNodes parses a comma-separated list of relays for EntryNodes, rejecting anything Tor wouldn't accept.
+func ParseNodes(list string) (out []string, err error) {
+	for _, node := range strings.Split(list, ",") {
+		if node = strings.TrimSpace(node); node == "" {
+			continue
+		}
+
+		if !nodeRE.MatchString(node) {
+			return nil, fmt.Errorf("invalid relay %q; expected a fingerprint, nickname or {cc}", node)
+		}
+
+		out = append(out, node)
+	}
+
+	return out, nil
+}
+
+// CheckNodes makes sure the entry nodes leave room for an exit in every pool. Tor never builds a circuit through two
+// relays in the same /16 or family, so when both ends are pinned to the same single country it will usually find no
+// path at all and never bootstrap.
+func CheckNodes(entries []string, pools PoolList) error {
+	if len(entries) != 1 || !strings.HasPrefix(entries[0], "{") {
+		return nil
+	}
+
+	cc := strings.ToLower(strings.Trim(entries[0], "{}"))
+	for _, p := range pools {
+		if p.Pins(cc) {
+			return fmt.Errorf("pool on port %d may exit only in %s, which is also the only country allowed for entry guards", p.Port, cc)
+		}
+	}
+
+	return nil
+}
+
+// SOCKS_FLAGS lists the SocksPort flags that may be given with -socks-flags. IsolateSOCKSAuth has a flag of its own.
+var SOCKS_FLAGS = map[string]bool{
+	"NoIPv4Traffic":             true,
+	"IPv6Traffic":               true,
+	"PreferIPv6":                true,
+	"NoDNSRequest":              true,
+	"NoOnionTraffic":            true,
+	"OnionTrafficOnly":          true,
+	"CacheIPv4DNS":              true,
+	"CacheIPv6DNS":              true,
+	"CacheDNS":                  true,
+	"UseIPv4Cache":              true,
+	"UseIPv6Cache":              true,
+	"UseDNSCache":               true,
+	"PreferIPv6Automap":         true,
+	"PreferSOCKSNoAuth":         true,
+	"IsolateClientAddr":         true,
+	"NoIsolateClientAddr":       true,
+	"IsolateClientProtocol":     true,
+	"IsolateDestPort":           true,
+	"IsolateDestAddr":           true,
+	"KeepAliveIsolateSOCKSAuth": true,
+	"ExtendedErrors":            true,
+}
+
+// extraSocksFlags holds the parsed -socks-flags list.
+var extraSocksFlags []string
+
+// ParseSocksFlags parses a comma-separated list of SocksPort flags, rejecting unknown flags and combinations that
+// would leave Tor with a port that refuses every stream.
+func ParseSocksFlags(list string) (out []string, err error) {
+	set := make(map[string]bool)
+	for _, f := range strings.Split(list, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+
+		if strings.EqualFold(f, "IsolateSOCKSAuth") || strings.EqualFold(f, "NoIsolateSOCKSAuth") {
+			return nil, fmt.Errorf("use -isolate-socks-auth instead of %s", f)
+		}
+
+		if !SOCKS_FLAGS[f] {
+			return nil, fmt.Errorf("unknown SocksPort flag %q", f)
+		}
+
+		if !set[f] {
+			set[f] = true
+			out = append(out, f)
+		}
+	}
+
+	ipv6Traffic := set["IPv6Traffic"] || cfg.IPv6
+	switch {
+	case set["OnionTrafficOnly"] && set["NoOnionTraffic"]:
+		return nil, fmt.Errorf("OnionTrafficOnly and NoOnionTraffic together would refuse every stream")
+	case set["NoIPv4Traffic"] && !ipv6Traffic && set["NoOnionTraffic"]:
+		return nil, fmt.Errorf("NoIPv4Traffic without IPv6Traffic and with NoOnionTraffic would refuse every stream")
+	case set["PreferIPv6"] && !ipv6Traffic:
+		return nil, fmt.Errorf("PreferIPv6 needs IPv6Traffic or -ipv6")
+	}
+
+	return out, nil
+}
+
+// bootstrapSlots limits how many Tor instances may bootstrap at the same time. It is nil when unlimited.
+var bootstrapSlots chan struct{}
+
+// StartTor starts a Tor instance and begins processing its output. When waitBootstrap is set, or the number of
+// concurrent bootstraps is limited, it doesn't return until Tor has finished bootstrapping; in the latter case it also
+// waits for a free bootstrap slot before starting Tor at all.
+func StartTor(ctx context.Context, countries []string, waitBootstrap bool) (t *Tor, err error) {
+	if bootstrapSlots != nil {
+		select {
+		case <-ctx.Done():
+			return nil, ErrTerminating
+		case bootstrapSlots <- struct{}{}:
+		}
+		defer func() { <-bootstrapSlots }()
+
+		waitBootstrap = true
+	}
+
+	if t, err = NewTor(ctx, countries, waitBootstrap); err != nil {
+		return nil, err
+	}
+
+	go t.Wait()
+
+	if waitBootstrap {
+		if err = t.WaitBootstrapped(ctx); err != nil {
+			t.log.Warn("failed to bootstrap", zap.Error(err))
+			t.Close()
+			return nil, err
+		}
+
+		t.log.Info("bootstrapped")
+	}
+
+	return t, nil
+}
+
+// trackBootstrap reports whether anything depends on following Tor's bootstrap progress.
+func trackBootstrap() bool {
+	return cfg.WarmSpares > 0 || cfg.BootstrapConcurrency > 0 || cfg.BootstrapTimeout > 0 || cfg.SharedCache
+}
+
+// torIDs numbers Tor instances that listen on a Unix socket, since they have no port to tell them apart.
+var torIDs int32
+
+// torPort returns the port for a new Tor instance. When Tor listens on a Unix socket, no port is needed, so it returns
+// an instance number instead.
+func torPort() (int, error) {
+	if cfg.TorSocket {
+		return int(atomic.AddInt32(&torIDs, 1)), nil
+	}
+
+	return portPlz()
+}
+
+// Configure assigns the SOCKS port for this instance, along with everything derived from it. When Tor listens on a Unix
+// socket, port only identifies the instance.
+func (t *Tor) Configure(port int) {
+	t.port = port
+	t.dir = path.Join(runDir, fmt.Sprintf("tor-%d", t.port))
+	t.pid = path.Join(t.dir, "tor.pid")
+
+	if useControl() {
+		t.control = path.Join(t.dir, "control.sock")
+	}
+
+	if cfg.TorSocket {
+		t.socket = path.Join(t.dir, "socks.sock")
+		t.log = log.With(zap.String("service", "tor"),
+			zap.Int64("proxy", t.proxy),
+			zap.Int("id", t.port),
+			zap.String("socket", t.socket))
+	} else {
+		t.log = log.With(zap.String("service", "tor"), zap.Int64("proxy", t.proxy), zap.Int("port", t.port))
+	}
+}
+
+// TCPPort returns the TCP port Tor accepts SOCKS connections on, or 0 when it listens on a Unix socket.
+func (t *Tor) TCPPort() int {
+	if t == nil || t.socket != "" {
+		return 0
+	}
+
+	return t.port
+}
+
+// SocksAddress returns the address Privoxy should forward requests to.
+func (t *Tor) SocksAddress() string {
+	if t.socket != "" {
+		return "unix:" + t.socket
+	}
+
+	return fmt.Sprintf("127.0.0.1:%d", t.port)
+}
+
+// Args returns the command line used to launch this Tor instance.
+func (t *Tor) Args() []string {
+	listen := t.socket
+	if listen != "" {
+		listen = "unix:" + listen
+	} else {
+		listen = fmt.Sprintf("%d", t.port)
+	}
+
+	var socks []string
+	if cfg.IPv6 {
+		// allow streams from this port to be exited over IPv6
+		socks = append(socks, "IPv6Traffic")
+	}
+
+	// streams using different SOCKS credentials get different circuits
+	if cfg.IsolateSOCKSAuth {
+		socks = append(socks, "IsolateSOCKSAuth")
+	} else {
+		socks = append(socks, "NoIsolateSOCKSAuth")
+	}
+
+	for _, f := range extraSocksFlags {
+		// -ipv6 already asked for it
+		if f == "IPv6Traffic" && cfg.IPv6 {
+			continue
+		}
+		socks = append(socks, f)
+	}
+
+	flags := strings.Join(socks, " ")
+	args := []string{
+		"--allow-missing-torrc",
+		"--SocksPort", listen + " " + flags,
+	}
+
+	// streams arriving on different SocksPorts never share a circuit
+	for _, port := range t.extraPorts {
+		args = append(args, "--SocksPort", fmt.Sprintf("%d %s", port, flags))
+	}
+
+	args = append(args,
+		"--NewCircuitPeriod", fmt.Sprintf("%d", cfg.CircuitTime),
+		"--DataDirectory", t.dir,
+		"--PidFile", t.pid,
+		"--Log", cfg.TorLogLevel+" stdout")
+
+	// bootstrap progress is only reported at notice level
+	if t.watchBootstrap && !logsNotice(cfg.TorLogLevel) {
+		args = append(args, "--Log", "notice-notice stdout")
+	}
+
+	if t.control != "" {
+		args = append(args, "--ControlSocket", t.control, "--CookieAuthentication", "1")
+	}
+
+	if cfg.CircuitDirtiness > 0 {
+		args = append(args, "--MaxCircuitDirtiness", fmt.Sprintf("%d", cfg.CircuitDirtiness))
+	}
+
+	if cfg.IPv6 {
+		args = append(args, "--IPv6Exit", "1")
+	}
+
+	// all of Tor's connections go through the upstream proxy using CONNECT
+	if cfg.UpstreamProxy != "" {
+		args = append(args, "--HTTPSProxy", cfg.UpstreamProxy)
+		if cfg.UpstreamProxyAuth != "" {
+			args = append(args, "--HTTPSProxyAuthenticator", cfg.UpstreamProxyAuth)
+		}
+	}
+
+	if len(t.countries) > 0 {
+		var nodes []string
+		for _, cc := range t.countries {
+			nodes = append(nodes, "{"+cc+"}")
+		}
+
+		args = append(args, "--ExitNodes", strings.Join(nodes, ","))
+	}
+
+	// a fixed set of guards keeps every instance entering the network the same way
+	if len(guardNodes) > 0 {
+		args = append(args, "--EntryNodes", strings.Join(guardNodes, ","))
+	}
+
+	// exits that recently failed their health checks
+	if excluded := exitBlacklist.List(); len(excluded) > 0 {
+		args = append(args, "--ExcludeExitNodes", strings.Join(excluded, ","))
+	}
+
+	if len(t.countries) > 0 || len(guardNodes) > 0 {
+		args = append(args, "--StrictNodes", "1")
+	}
+
+	return args
+}
+
+// Listening reports whether Tor has opened its SOCKS port.
+func (t *Tor) Listening() bool {
+	if t.socket != "" {
+		return socketListening(t.socket)
+	}
+
+	return portListening(t.port)
+}
+
+func (t *Tor) MakeDirs() (err error) {
+	if err = os.MkdirAll(t.dir, 0700); err != nil {
+		return
+	}
+
+	return nil
+}
+
+func (t *Tor) TorLogger(line string) (level, msg string, fields []zap.Field) {
+	m := torLogRE.FindStringSubmatch(line)
+	if m == nil {
+		// not something we recognize, such as a startup error, so pass it along as is
+		return "", line, nil
+	}
+	level, msg = m[1], m[2]
+
+	if m := bootstrapRE.FindStringSubmatch(msg); m != nil {
+		pct, _ := strconv.Atoi(m[1])
+		prev := atomic.SwapInt32(&t.bootstrap, int32(pct))
+
+		// a freshly bootstrapped instance has everything the shared cache needs
+		if pct == 100 && prev < 100 && torCache != nil {
+			go torCache.Refresh(t.log, t.dir)
+		}
+
+		phase := m[2]
+		if phase == "" {
+			phase = strings.TrimSuffix(m[3], ".")
+		}
+
+		fields = append(fields, zap.Int("bootstrap", pct), zap.String("phase", phase))
+	} else if level == "notice" && !logsNotice(cfg.TorLogLevel) {
+		// only asked for to follow bootstrap progress, so keep the rest out of the way
+		level = "debug"
+	}
+
+	return
+}
+
+// logsNotice reports whether Tor's configured log level includes notice messages.
+func logsNotice(level string) bool {
+	switch level {
+	case "notice", "info", "debug":
+		return true
+	}
+
+	return false
+}
+
+// WaitBootstrapped blocks until Tor reports that it has fully bootstrapped, it exits, ctx is canceled, or the bootstrap
+// timeout passes.
+func (t *Tor) WaitBootstrapped(ctx context.Context) error {
+	return t.waitBootstrapped(ctx, cfg.BootstrapTimeout)
+}
+
+// waitBootstrapped is WaitBootstrapped with the bootstrap timeout given, so that it needn't read the Config.
+func (t *Tor) waitBootstrapped(ctx context.Context, limit time.Duration) error {
+	tick := time.NewTicker(250 * time.Millisecond)
+	defer tick.Stop()
+
+	var timeout <-chan time.Time
+	if limit > 0 {
+		timeout = time.After(limit)
+	}
+
+	for t.Bootstrapped() < 100 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.Done():
+			return fmt.Errorf("tor exited while bootstrapping")
+		case <-timeout:
+			t.log.Warn("tor did not bootstrap in time",
+				zap.Duration("timeout", limit),
+				zap.Int("bootstrap", t.Bootstrapped()))
+			return ErrBootstrapTimeout
+		case <-tick.C:
+		}
+	}
+
+	return nil
+}
+
+// Stuck returns a channel that is closed if Tor doesn't finish bootstrapping within the bootstrap timeout. The channel
+// is never closed if Tor bootstraps, exits, or ctx is canceled first.
+func (t *Tor) Stuck(ctx context.Context) <-chan struct{} {
+	stuck := make(chan struct{})
+	limit := cfg.BootstrapTimeout
+	if t == nil || limit <= 0 {
+		return stuck
+	}
+
+	// this may outlive the proxy, so the timeout is read before it starts
+	go func() {
+		if errors.Is(t.waitBootstrapped(ctx, limit), ErrBootstrapTimeout) {
+			close(stuck)
+		}
+	}()
+
+	return stuck
+}
+
+// Bootstrapped returns the last bootstrap percentage reported by Tor.
+func (t *Tor) Bootstrapped() int {
+	if t.parent != nil {
+		return t.parent.Bootstrapped()
+	}
+
+	return int(atomic.LoadInt32(&t.bootstrap))
+}
+
+// View returns a Tor standing for the i-th SocksPort of t, which has several, for a proxy of its own. Every view shares
+// t's process, which is closed once every view has been closed and Release has been called on t itself.
+func (t *Tor) View(i int) *Tor {
+	atomic.AddInt32(&t.leases, 1)
+
+	v := &Tor{
+		cmd:       t.cmd,
+		port:      t.port,
+		dir:       t.dir,
+		control:   t.control,
+		pid:       t.pid,
+		countries: t.countries,
+		proxy:     NextProxyID(),
+		parent:    t,
+	}
+	if i > 0 {
+		v.port = t.extraPorts[i-1]
+	}
+
+	v.log = log.With(zap.String("service", "tor"),
+		zap.Int64("proxy", v.proxy),
+		zap.Int("port", v.port),
+		zap.Int("instance", t.port))
+
+	return v
+}
+
+// Release drops a reference to an instance with several SocksPorts, closing it if that was the last one.
+func (t *Tor) Release() error {
+	if atomic.AddInt32(&t.leases, -1) > 0 {
+		return nil
+	}
+
+	return t.Close()
+}
+
+// Done returns a channel that is closed when Tor exits. Without a Tor, the channel is never closed.
+func (t *Tor) Done() <-chan struct{} {
+	if t == nil {
+		return nil
+	}
+
+	return t.cmd.Done()
+}
+
+func (t *Tor) Wait() {
+	t.cmd.Wait()
+}
+
+func (t *Tor) Close() (err error) {
+	if t == nil || t.dir == "" {
+		return nil
+	}
+
+	// the process carries on for as long as any other view needs it
+	if t.parent != nil {
+		return t.parent.Release()
+	}
+
+	defer func() {
+		if err = RemoveData(t.log, "tor", t.dir); err != nil {
+			t.log.Error("failed to remove data directory", zap.String("path", t.dir), zap.Error(err))
+		}
+		releasePorts(append(t.extraPorts, t.TCPPort())...)
+	}()
+
+	// never got as far as starting
+	if t.cmd == nil {
+		return nil
+	}
+
+	t.cmd.log.Info("cleaning up")
+	if err = t.cmd.Close(); err != nil {
+		if !errors.Is(err, ErrProcessKilled) {
+			t.cmd.log.Error("failed to kill server", zap.Error(err))
+		}
+		return
+	}
+
+	return nil
+}
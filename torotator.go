@@ -0,0 +1,380 @@
+// Package torotator runs pools of rotating Tor proxies behind HAProxy. Each pool keeps a number of Tor+Privoxy pairs
+// running and replaces them as they expire or fail, so that clients of the pool's HTTP proxy port see their exit change
+// over time. A Manager runs every pool according to a Config.
+package torotator
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/uber-go/zap"
+)
+
+var (
+	pools     PoolList
+	haproxies []*HAProxy
+
+	// log starts out as the default Config's, and is replaced by the Manager's
+	log = cfg.Log
+
+	// runProxy is what Rotate runs in each slot, which tests replace
+	runProxy = RunProxy
+)
+
+// Rotate manages pairs of Tor+Privoxy services. Only a specific number of pairs are permitted at one time. When a pair
+// expires, a new pair will automatically take its place.
+func Rotate(ctx context.Context, wg *sync.WaitGroup, ha *HAProxy) {
+	// bootstrapped Tor instances waiting to replace expired proxies
+	spares := NewSpares(ctx, ha.pool, cfg.WarmSpares)
+
+	// in fan-out mode every Tor instance sits behind the same Privoxy
+	var shared *SharedPrivoxy
+	if cfg.FanoutInterval > 0 {
+		shared = NewSharedPrivoxy(ha)
+
+		wg.Add(1)
+		go func() {
+			shared.Run(ctx, cfg.FanoutInterval)
+			wg.Done()
+		}()
+	}
+
+	// when the last proxy was started, and how many have been, so replacements can be spaced out
+	var (
+		last    time.Time
+		started int
+	)
+
+	if cfg.StartupStagger > 0 && ha.Size() > 1 {
+		ha.log.Info("filling pool gradually", zap.Int("size", ha.Size()), zap.Duration("stagger", cfg.StartupStagger))
+	}
+
+	for {
+		// wait for a free slot, which blocks for as long as the pool is full. The slots limit the number of running
+		// proxies separately from wg, which is unbounded.
+		if ha.slots.Acquire(ctx) != nil {
+			// application terminating
+			return
+		}
+
+		// with every port taken, trying again right away would only fail again
+		if exhaustion.Wait(ctx) != nil {
+			return
+		}
+
+		// the first proxies are started a little apart so that their Tor instances don't all bootstrap at once
+		if cfg.StartupStagger > 0 && started > 0 && started < ha.Size() {
+			delay := StaggerDelay()
+			ha.log.Debug("staggering startup", zap.Int("proxy", started+1), zap.Duration("delay", delay))
+			if Sleep(ctx, delay) != nil {
+				return
+			}
+		}
+
+		// filling the pool isn't held back, only replacing proxies afterwards
+		if cfg.ReplaceInterval > 0 && started >= ha.Size() {
+			if Sleep(ctx, time.Until(last.Add(cfg.ReplaceInterval))) != nil {
+				return
+			}
+		}
+		started++
+		last = time.Now()
+
+		// time to create a new pair. The slot may be given up before the pair is torn down, so that its replacement
+		// can start while it hangs on.
+		var once sync.Once
+		release := func() { once.Do(ha.slots.Release) }
+
+		wg.Add(1)
+		go func() {
+			if shared != nil {
+				RunFanout(ctx, shared, spares)
+			} else {
+				runProxy(ctx, ha, spares, release)
+			}
+
+			wg.Done()
+			release()
+		}()
+	}
+}
+
+// proxyIDs numbers proxies so that one can be followed through the logs of Tor, Privoxy and HAProxy.
+var proxyIDs int64
+
+// NextProxyID returns a new, unique proxy ID.
+func NextProxyID() int64 {
+	return atomic.AddInt64(&proxyIDs, 1)
+}
+
+// RunProxy obtains a Tor node, followed by a Privoxy instance that handles proxying HTTP requests to the new Tor node.
+// The HAProxy instance is notified of the new pair so it can reconfigure itself to use the new pair. If either the Tor
+// node or the Privoxy service fail, the pair is invalidated and removed from HAProxy.
+func RunProxy(ctx context.Context, ha *HAProxy, spares *Spares, release func()) {
+	// some share of the pool may skip Tor altogether for comparison
+	direct := ha.ClaimDirect()
+	if direct {
+		defer ha.ReleaseDirect()
+	}
+
+	// create a new tor/privoxy pair, using a warm spare Tor if one is available
+	var (
+		tor     *Tor
+		privoxy *Privoxy
+		torPort int
+		proxy   int64
+		err     error
+	)
+	if !direct {
+		if tor, privoxy, err = StartPair(ctx, spares); err == nil {
+			torPort = tor.port
+			proxy = tor.proxy
+		}
+	} else {
+		proxy = NextProxyID()
+		privoxy, err = NewPrivoxy(ctx, proxy, nil)
+	}
+
+	// running out of ports holds back every new proxy until some free up
+	exhaustion.Check(err)
+	if err != nil {
+		return
+	}
+
+	// mark the ports as used
+	mapPorts(tor.TCPPort(), privoxy.port)
+
+	_log := log.With(zap.Int64("proxy", proxy),
+		zap.Int("pool", ha.Port),
+		zap.Int("tor", torPort),
+		zap.Int("privoxy", privoxy.port))
+	if direct {
+		_log = _log.With(zap.Bool("direct", true))
+	}
+	started := time.Now()
+
+	// notify HAProxy of the new backend
+	ha.AddBackend(ctx, privoxy.port, &Backend{Proxy: proxy, Direct: direct})
+
+	// let the processes run until they terminate
+	go privoxy.Wait()
+
+	// the proxy only counts as started once HAProxy reports it as up, and is recycled if that never happens
+	notLive := make(chan struct{})
+	go func() {
+		if cfg.LiveTimeout > 0 {
+			if err := ha.WaitLive(ctx, privoxy.port); err != nil {
+				if errors.Is(err, ErrNotLive) {
+					_log.Warn("haproxy never reported proxy as up", zap.Duration("timeout", cfg.LiveTimeout))
+					close(notLive)
+				}
+				return
+			}
+		}
+
+		if direct {
+			_log.Warn("proxy started without tor; requests will come from this host's own IP")
+		} else {
+			_log.Info("proxy started", zap.Duration("live_after", time.Since(started)))
+		}
+		events.Emit(Event{Event: EVENT_PROXY_STARTED, Proxy: proxy, Tor: torPort, Privoxy: privoxy.port, Direct: direct})
+	}()
+
+	recycle := recycler.Register(privoxy.port)
+	defer recycler.Unregister(recycle)
+
+	var expire <-chan time.Time
+	if ProxiesExpire() {
+		lifetime := ProxyLifetime()
+		_log.Debug("proxy lifetime chosen", zap.Duration("lifetime", lifetime))
+		expire = time.After(lifetime)
+	}
+
+	// a Tor that never finishes bootstrapping is torn down so its slot can go to a fresh one
+	stuck := tor.Stuck(ctx)
+
+	// with health checks, a proxy whose exit keeps failing is replaced, unless only Privoxy is to blame
+	unhealthy, privoxyFailed := MonitorProxy(ctx, _log, tor, privoxy, func(info *ExitInfo) {
+		ha.RecordLatency(privoxy.port, info)
+	})
+
+	if cfg.RotationStrategy == "per-request" && tor != nil {
+		go NewCircuitPerRequest(ctx, _log, ha, privoxy.port, tor)
+	}
+
+	if cfg.CircuitInfo && tor != nil {
+		go TrackCircuit(ctx, _log, ha, privoxy.port, tor)
+	}
+
+	// wait for any of the following events to occur
+	var reason string
+	for reason == "" {
+		select {
+		case <-ctx.Done():
+			// application terminating
+			reason = RECYCLE_SHUTDOWN
+		case <-tor.Done():
+			// tor ended
+			reason = RECYCLE_TOR_EXITED
+		case <-stuck:
+			// tor never finished bootstrapping
+			reason = RECYCLE_TOR_STUCK
+		case <-privoxy.Done():
+			// privoxy ended
+			reason = RECYCLE_PRIVOXY_EXITED
+		case <-expire:
+			// proxy lifetime expired
+			reason = RECYCLE_EXPIRED
+		case <-recycle:
+			// asked to recycle early
+			reason = RECYCLE_REQUESTED
+		case <-unhealthy:
+			// exit kept failing health checks
+			reason = RECYCLE_UNHEALTHY
+		case <-notLive:
+			// HAProxy never started sending it traffic
+			reason = RECYCLE_NOT_LIVE
+		case <-privoxyFailed:
+			// Tor is fine, so only Privoxy is replaced
+			if err = privoxy.Restart(ctx); err != nil {
+				_log.Error("failed to restart privoxy", zap.Error(err))
+				reason = RECYCLE_PRIVOXY_EXITED
+			}
+		}
+	}
+
+	// a proxy the pool shrank away from has been drained already, and has nothing to wait for
+	retiring := ha.Retiring(privoxy.port)
+	if retiring && reason == RECYCLE_REQUESTED {
+		reason = RECYCLE_SCALED_DOWN
+	}
+
+	// a proxy that is still working hangs on until enough others are healthy to take its place
+	if (reason == RECYCLE_EXPIRED || reason == RECYCLE_REQUESTED) && cfg.MinHealthy > 0 {
+		release()
+		WaitForHealthy(ctx, _log, ha, privoxy.port, tor, privoxy)
+	}
+
+	// tally what went through this proxy before HAProxy forgets about it
+	if _, err = ha.UpdateTraffic(); err != nil {
+		_log.Debug("unable to update traffic totals", zap.Error(err))
+	}
+	bytesIn, bytesOut := ha.Traffic(privoxy.port)
+
+	// tell HAProxy to remove this backend
+	ha.RemoveBackend(ctx, privoxy.port)
+
+	// clean up after ourselves
+	_log.Info("stopping proxy")
+	privoxy.Close()
+	tor.Close()
+
+	// release the port for later use
+	unmapPorts(tor.TCPPort(), privoxy.port)
+	if retiring {
+		release()
+		ha.Retired()
+	}
+
+	age := time.Since(started)
+	ha.Recycled(privoxy.port, proxy, reason, age)
+	_log.Info("proxy terminated",
+		zap.String("reason", reason),
+		zap.Duration("age", age),
+		zap.Int64("bytes_in", bytesIn),
+		zap.Int64("bytes_out", bytesOut))
+	events.Emit(Event{
+		Event:   EVENT_PROXY_RECYCLED,
+		Proxy:   proxy,
+		Tor:     torPort,
+		Privoxy: privoxy.port,
+		Reason:  reason,
+		Age:     age.Seconds(),
+		Direct:  direct,
+
+		BytesIn:  bytesIn,
+		BytesOut: bytesOut,
+	})
+}
+
+// StartPair starts a Tor instance, using a warm spare if one is available, along with the Privoxy that forwards to it. By
+// default Privoxy isn't started until Tor is running. With -startup-order parallel, Privoxy starts alongside Tor and is
+// pointed at it once Tor is running. Should either fail to start, the other is torn down.
+func StartPair(ctx context.Context, spares *Spares) (tor *Tor, privoxy *Privoxy, err error) {
+	if cfg.StartupOrder == "sequential" {
+		if tor, err = spares.Get(ctx); err != nil {
+			// a failed Tor has already cleaned up after itself
+			return nil, nil, err
+		}
+
+		if privoxy, err = NewPrivoxy(ctx, tor.proxy, tor); err != nil {
+			tor.Close()
+			return nil, nil, err
+		}
+
+		return tor, privoxy, nil
+	}
+
+	var privoxyErr error
+	started := make(chan struct{})
+	go func() {
+		privoxy, privoxyErr = NewPendingPrivoxy(ctx)
+		close(started)
+	}()
+
+	tor, err = spares.Get(ctx)
+	<-started
+
+	if err == nil {
+		err = privoxyErr
+	}
+
+	if err == nil {
+		// Privoxy takes on the proxy ID given to Tor
+		privoxy.proxy = tor.proxy
+		if err = privoxy.Attach(tor); err != nil {
+			privoxy.log.Error("failed to point privoxy at tor", zap.Error(err))
+		}
+	}
+
+	if err != nil {
+		// both are safe to close whether or not they started
+		privoxy.Close()
+		tor.Close()
+		return nil, nil, err
+	}
+
+	return tor, privoxy, nil
+}
+
+// WaitForHealthy blocks until the pool has at least the minimum number of healthy backends besides the one on port, the
+// minimum healthy wait elapses, ctx is canceled, or either process ends.
+func WaitForHealthy(ctx context.Context, _log zap.Logger, ha *HAProxy, port int, tor *Tor, privoxy *Privoxy) {
+	if ha.HealthyBackends(port) >= cfg.MinHealthy {
+		return
+	}
+
+	_log.Info("waiting for a replacement before stopping proxy", zap.Int("healthy", ha.HealthyBackends(port)))
+
+	timeout := time.After(cfg.MinHealthyWait)
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+
+	for ha.HealthyBackends(port) < cfg.MinHealthy {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tor.Done():
+			return
+		case <-privoxy.Done():
+			return
+		case <-timeout:
+			_log.Warn("gave up waiting for a replacement", zap.Int("healthy", ha.HealthyBackends(port)))
+			return
+		case <-tick.C:
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package torotator
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/uber-go/zap"
+)
+
+// fakes holds the stand-ins for tor, privoxy and haproxy built from fakes/ for tests that run them, see fakeBin.
+var fakes struct {
+	once sync.Once
+	dir  string
+	err  error
+}
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+
+	if fakes.dir != "" {
+		os.RemoveAll(fakes.dir)
+	}
+
+	os.Exit(code)
+}
+
+// fakeBin returns the path of the stand-in for name, one of tor, privoxy or haproxy, building them the first time.
+func fakeBin(t *testing.T, name string) string {
+	t.Helper()
+
+	fakes.once.Do(func() {
+		if fakes.dir, fakes.err = os.MkdirTemp("", "torotator-fakes"); fakes.err != nil {
+			return
+		}
+
+		if out, err := exec.Command("go", "build", "-o", filepath.Join(fakes.dir, "fake"), "./fakes").CombinedOutput(); err != nil {
+			fakes.err = fmt.Errorf("failed to build fakes: %v: %s", err, out)
+			return
+		}
+
+		// the fake behaves like whichever program it is invoked as
+		for _, bin := range []string{"tor", "privoxy", "haproxy"} {
+			if fakes.err = os.Symlink("fake", filepath.Join(fakes.dir, bin)); fakes.err != nil {
+				return
+			}
+		}
+	})
+
+	if fakes.err != nil {
+		t.Fatal(fakes.err)
+	}
+
+	return filepath.Join(fakes.dir, name)
+}
+
+// testConfig points the package at a fresh Config for the length of a test, with its state and the services' data kept
+// in a temporary directory and its logs thrown away.
+func testConfig(t *testing.T) *Config {
+	t.Helper()
+
+	c := DefaultConfig()
+	c.DataDir = t.TempDir()
+	c.Log = zap.New(zap.NewJSONEncoder(), zap.Output(zap.AddSync(io.Discard)))
+
+	prevCfg, prevLog, prevRunDir := cfg, log, runDir
+	prevTuned, prevAllow := tunedConfig()
+	cfg, log, runDir = c, c.Log, c.DataDir
+	setTuned(c, nil)
+	t.Cleanup(func() {
+		cfg, log, runDir = prevCfg, prevLog, prevRunDir
+		setTuned(prevTuned, prevAllow)
+	})
+
+	return c
+}
+
+// cpuTime returns how much CPU time the process has used so far.
+func cpuTime(t *testing.T) time.Duration {
+	t.Helper()
+
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		t.Fatal(err)
+	}
+
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
+
+func TestRotateIdlesWhenFull(t *testing.T) {
+	const size = 3
+
+	c := testConfig(t)
+	c.WarmSpares = 0
+	c.StartupStagger = 0
+
+	ha, err := ConfigureHAProxy(&Pool{Port: 18992, Count: size})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each proxy runs until it is told to stop
+	var (
+		started int32
+		stop    = make(chan struct{})
+	)
+	prevRunProxy := runProxy
+	runProxy = func(ctx context.Context, ha *HAProxy, spares *Spares, release func()) {
+		atomic.AddInt32(&started, 1)
+		select {
+		case <-ctx.Done():
+		case <-stop:
+		}
+	}
+	defer func() { runProxy = prevRunProxy }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	rotated := make(chan struct{})
+	go func() {
+		Rotate(ctx, &wg, ha)
+		close(rotated)
+	}()
+	defer func() {
+		cancel()
+		<-rotated
+		wg.Wait()
+	}()
+
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt32(&started) < size; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d of %d proxies started", atomic.LoadInt32(&started), size)
+		}
+	}
+
+	// with the pool full, Rotate waits for a slot without using the CPU
+	before := cpuTime(t)
+	time.Sleep(500 * time.Millisecond)
+	if used := cpuTime(t) - before; used > 100*time.Millisecond {
+		t.Errorf("used %s of CPU in 500ms with a full pool", used)
+	}
+
+	if n := atomic.LoadInt32(&started); n != size {
+		t.Fatalf("%d proxies started for a pool of %d", n, size)
+	}
+
+	// a proxy ending frees its slot for a replacement
+	stop <- struct{}{}
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt32(&started) < size+1; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("no replacement started")
+		}
+	}
+}
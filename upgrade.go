@@ -0,0 +1,168 @@
+package torotator
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/uber-go/zap"
+)
+
+// UPGRADE_ENV tells a torotator started by an upgrade which HAProxy instances it replaces, as comma-separated
+// PORT=PIDFILE pairs, one for each pool.
+const UPGRADE_ENV = "TOROTATOR_UPGRADE_FROM"
+
+// LISTEN_RETRY is how often a process started by an upgrade tries again to listen on an address the process it replaces
+// is still holding.
+const LISTEN_RETRY = time.Second
+
+var (
+	// takeovers maps each pool's port to the pid file of the HAProxy instance it replaces. It is nil unless this
+	// process was started by an upgrade.
+	takeovers map[int]string
+
+	// runDir is where each service keeps its runtime data. It is the data directory itself, except in a process
+	// started by an upgrade, whose services would otherwise collide with those of the process it replaces.
+	runDir string
+
+	// handingOff is set while a new process is taking over, which stops HAProxy from being reloaded so that its pid
+	// file keeps naming the instance the new process will replace
+	handingOff int32
+)
+
+// Upgrading reports whether this process was started by an upgrade to replace a running torotator.
+func Upgrading() bool {
+	return takeovers != nil
+}
+
+// HandingOff reports whether a new process is taking over from this one.
+func HandingOff() bool {
+	return atomic.LoadInt32(&handingOff) == 1
+}
+
+// ParseTakeovers parses the value of UPGRADE_ENV. An empty value means this process wasn't started by an upgrade.
+func ParseTakeovers(value string) (out map[int]string, err error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	out = make(map[int]string)
+	for _, pair := range strings.Split(value, ",") {
+		eq := strings.Index(pair, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("invalid takeover %q; expected PORT=PIDFILE", pair)
+		}
+
+		port, err := strconv.Atoi(pair[:eq])
+		if err != nil {
+			return nil, fmt.Errorf("invalid takeover port %q", pair[:eq])
+		}
+
+		out[port] = pair[eq+1:]
+	}
+
+	return out, nil
+}
+
+// SetupRunDir decides where services keep their runtime data, giving a process started by an upgrade a directory of its
+// own beneath the data directory.
+func SetupRunDir() {
+	runDir = cfg.DataDir
+	if Upgrading() {
+		runDir = path.Join(cfg.DataDir, fmt.Sprintf("upgrade-%d", os.Getpid()))
+	}
+}
+
+// readPid returns the pid recorded in the pid file at name.
+func readPid(name string) (int, error) {
+	raw, err := os.ReadFile(name)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(strings.TrimSpace(string(raw)))
+}
+
+// Listen listens for TCP connections on addr. A process started by an upgrade keeps trying until the process it
+// replaces lets go of addr, or ctx is canceled.
+func Listen(ctx context.Context, addr string) (l net.Listener, err error) {
+	for {
+		if l, err = net.Listen("tcp", addr); err == nil || !Upgrading() {
+			return l, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(LISTEN_RETRY):
+		}
+	}
+}
+
+// HandOff starts a new torotator with the same arguments and waits for it to take over. The new process builds its own
+// pools and, once they are ready, starts its HAProxy instances with -sf so that ours stop listening and finish their
+// current connections. Our proxies stay up until then, after which everything is shut down. If the new process exits
+// before taking over, this one carries on as if nothing happened.
+func (m *Manager) HandOff(ctx context.Context) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	var pidFiles []string
+	for _, ha := range m.haproxies {
+		pidFiles = append(pidFiles, fmt.Sprintf("%d=%s", ha.Port, ha.PidFile))
+	}
+
+	atomic.StoreInt32(&handingOff, 1)
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), UPGRADE_ENV+"="+strings.Join(pidFiles, ","))
+	if err = cmd.Start(); err != nil {
+		m.resume(ctx)
+		return err
+	}
+
+	log.Info("started new process", zap.Int("pid", cmd.Process.Pid))
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	// each HAProxy exits once the new process has told it to stop and its last connection has finished
+	for _, ha := range m.haproxies {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case err = <-exited:
+			m.resume(ctx)
+			return fmt.Errorf("new process exited before taking over: %v", err)
+
+		case <-ha.Done():
+		}
+	}
+
+	log.Info("new process has taken over; shutting down", zap.Int("pid", cmd.Process.Pid))
+	m.cancel()
+
+	return nil
+}
+
+// resume picks up where a failed handoff left off, applying any changes held back while it was underway.
+func (m *Manager) resume(ctx context.Context) {
+	atomic.StoreInt32(&handingOff, 0)
+
+	for _, ha := range m.haproxies {
+		go ha.WriteConfig(ctx, true)
+	}
+}